@@ -1,67 +1,115 @@
 package client
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/manifoldco/promptui"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
+	"io"
 	"log"
 	"net"
 	"os"
 	"reseau2TP2/datatypes"
-	"strconv"
-	"strings"
-	"sync"
+	"time"
 )
 
+const negotiationTimeout = 2 * time.Second
+
+// keepAliveInterval is well below the server's UDP session expiry
+const keepAliveInterval = time.Minute
+
+var errTimeout = errors.New("timed out waiting for the server")
+
+// Errors returned without asking the server. Errors the server answers with
+// are *datatypes.ProtocolError and compare with the datatypes sentinels.
+var (
+	ErrNotLoggedIn     = errors.New("Not logged in")
+	ErrAlreadyLoggedIn = errors.New("Already logged in")
+	ErrAlreadyInGame   = errors.New("Already in a game")
+	ErrNotInGame       = errors.New("Not in a game")
+	// ErrCertificateMismatch means the TLS certificate of the server is not
+	// the one pinned in the config
+	ErrCertificateMismatch = errors.New("Server certificate does not match the pinned one")
+	// ErrUntrustedServerKey means the server key changed without being
+	// endorsed by the cached one
+	ErrUntrustedServerKey = errors.New("Server key changed without being endorsed by the cached one")
+	// ErrUnsupportedCommand is returned for requests the server did not
+	// announce in its hello
+	ErrUnsupportedCommand = errors.New("Command not supported by the server")
+	ErrInvalidResponse    = errors.New("Invalid response")
+)
+
+// clientCommands are the tags the client accepts from the server, announced
+// in the hello.
+var clientCommands = []uint8{0x01, 0x03, 0x04, datatypes.HelloTag, 0x80, 0x81, 0x82, datatypes.ShutdownTag, datatypes.ErrorTag, datatypes.MatchTag, datatypes.DrawOfferTag, datatypes.DrawDeclinedTag}
+
 type Client struct {
-	configFile      string
-	conn            net.Conn
-	connUDP         net.UDPConn
+	configFile  string
+	conn        net.Conn
+	connUDP     net.UDPConn
+	reader      *datatypes.FrameReader
+	framing     datatypes.Framing
+	compression bool
+	// hello is what the server agreed on, nil for servers older than it
+	hello           *datatypes.Hello
+	udpReliable     *datatypes.ReliableUDP
+	udpMessages     chan []byte
+	cipher          *datatypes.SessionCipher
 	KeyPair         datatypes.KeyPair
 	ServerPublicKey string
 	isLoggedIn      bool
 	inGame          bool
-	moveMutex       *sync.Mutex
-	moveWaitCancel  chan struct{}
-	awaitingMove    bool
+	mux             *multiplexer
 	logger          *log.Logger
 	mode            string
 }
 
 func Init(configFile string, i int) (Client, error) {
-	conn, err := net.Dial("tcp", "localhost:8080")
-	if err != nil {
-		return Client{}, err
+	logger := log.New(os.Stdout, fmt.Sprintf("Client %d: ", i), log.LstdFlags)
+	client := Client{
+		configFile: configFile,
+		mux:        newMultiplexer(),
+		logger:     logger,
 	}
 
-	udpServer, err := net.ResolveUDPAddr("udp", "localhost:8081")
+	err := createConfig(configFile)
 	if err != nil {
 		return Client{}, err
 	}
-	connUDP, err := net.DialUDP("udp", nil, udpServer)
+
+	conn, err := client.dialTCP()
 	if err != nil {
 		return Client{}, err
 	}
 
-	logger := log.New(os.Stdout, fmt.Sprintf("Client %d: ", i), log.LstdFlags)
-	client := Client{
-		configFile:     configFile,
-		conn:           conn,
-		connUDP:        *connUDP,
-		moveMutex:      &sync.Mutex{},
-		moveWaitCancel: make(chan struct{}),
-		logger:         logger,
+	udpServer, err := net.ResolveUDPAddr("udp", client.serverAddr("udp", "8081"))
+	if err != nil {
+		return Client{}, err
 	}
-
-	err = createConfig(configFile)
+	connUDP, err := net.DialUDP("udp", nil, udpServer)
 	if err != nil {
 		return Client{}, err
 	}
 
+	udpReliable := datatypes.NewReliableUDP(func(b []byte) error {
+		_, err := connUDP.Write(b)
+		return err
+	})
+	udpMessages := make(chan []byte, 64)
+	go readUDP(connUDP, udpReliable, udpMessages)
+
+	client.conn = conn
+	client.connUDP = *connUDP
+	client.reader = datatypes.NewFrameReader(conn)
+	client.udpReliable = udpReliable
+	client.udpMessages = udpMessages
+
 	keyPair := datatypes.KeyPair{
 		PublicKey:  client.getConfig("key.public"),
 		PrivateKey: client.getConfig("key.private"),
@@ -71,9 +119,149 @@ func Init(configFile string, i int) (Client, error) {
 	client.ServerPublicKey = client.getConfig("ServerPublicKey")
 	client.mode = client.getConfig("protocol")
 
+	err = client.negotiate()
+	if err != nil {
+		return Client{}, err
+	}
+
 	return client, nil
 }
 
+// dialTCP connects to the server, inside TLS when "tls" is set in the config.
+// The server certificate is self-signed, so instead of checking it against a
+// CA the client pins its fingerprint, stored in the config next to
+// ServerPublicKey, the first time it connects.
+func (c *Client) dialTCP() (net.Conn, error) {
+	if c.getConfig("tls") != "true" {
+		return net.Dial("tcp", c.serverAddr("tcp", "8080"))
+	}
+
+	pinned := c.getConfig("ServerCertificate")
+	var fingerprint string
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("Server sent no certificate")
+			}
+			sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+			fingerprint = hex.EncodeToString(sum[:])
+			if pinned != "" && fingerprint != pinned {
+				return ErrCertificateMismatch
+			}
+			return nil
+		},
+	}
+	conn, err := tls.Dial("tcp", c.serverAddr("tls", "8443"), config)
+	if err != nil {
+		return nil, err
+	}
+	if pinned == "" {
+		c.logger.Println("Pinning server certificate", fingerprint)
+		c.setConfig("ServerCertificate", fingerprint)
+	}
+	return conn, nil
+}
+
+// serverAddr returns the address of the server for transport, from "ip" and
+// "port.<transport>" in the config.
+func (c *Client) serverAddr(transport string, defaultPort string) string {
+	ip := c.getConfig("ip")
+	if ip == "" {
+		ip = "localhost"
+	}
+	port := c.getConfig("port." + transport)
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(ip, port)
+}
+
+// readUDP feeds every datagram from the server through the reliability layer
+// and queues the resulting messages. Datagrams from servers that do not speak
+// reliable UDP are queued as they are.
+func readUDP(conn *net.UDPConn, reliable *datatypes.ReliableUDP, messages chan<- []byte) {
+	defer close(messages)
+	defer reliable.Close()
+	for {
+		b := make([]byte, 65535)
+		n, err := conn.Read(b)
+		if err != nil {
+			return
+		}
+		if !datatypes.IsReliableDatagram(b[:n]) {
+			messages <- b[:n]
+			continue
+		}
+		received, err := reliable.Receive(b[:n])
+		if err != nil {
+			continue
+		}
+		for _, msg := range received {
+			messages <- msg
+		}
+	}
+}
+
+// negotiate sends a hello to agree with the server on the protocol version and
+// capabilities. Servers older than the hello answer with an error or not at
+// all, the framing is then negotiated on its own.
+func (c *Client) negotiate() error {
+	hello := datatypes.Hello{
+		Version:      datatypes.ProtocolVersion,
+		Capabilities: datatypes.SupportedCapabilities,
+		Commands:     clientCommands,
+	}
+	err := c.Send(hello.TLV())
+	if err != nil {
+		return err
+	}
+
+	tlv, err := c.receiveWithin(negotiationTimeout)
+	if errors.Is(err, errTimeout) || (err == nil && tlv.Tag != datatypes.HelloTag) {
+		c.logger.Println("Server did not answer hello, negotiating framing")
+		return c.negotiateFraming()
+	}
+	if err != nil {
+		return err
+	}
+	agreed, err := datatypes.ParseHello(tlv.Value)
+	if err != nil {
+		return err
+	}
+	c.hello = &agreed
+	c.framing = agreed.Framing()
+	c.compression = agreed.Has(datatypes.CapCompression)
+	return nil
+}
+
+// negotiateFraming asks the server to switch to multiplexed framing. Servers
+// that do not know the 0x01 tag never answer, in which case the client keeps
+// the legacy newline framing, and plain datagrams when using UDP.
+func (c *Client) negotiateFraming() error {
+	tlv := datatypes.NewTLV(0x01, []byte(datatypes.FramingMultiplexedName))
+	err := c.Send(tlv)
+	if err != nil {
+		return err
+	}
+
+	tlv, err = c.receiveWithin(negotiationTimeout)
+	if errors.Is(err, errTimeout) {
+		c.logger.Println("Server did not answer framing negotiation, using legacy framing")
+		c.udpReliable.Close()
+		c.udpReliable = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if tlv.Tag == 0x01 {
+		c.framing = datatypes.ParseFraming(string(tlv.Value))
+	}
+	return nil
+}
+
 func createConfig(configFile string) error {
 	log.SetPrefix("Client: ")
 	defer log.SetPrefix("Server: ")
@@ -91,9 +279,11 @@ func createConfig(configFile string) error {
 	"ip": "127.0.0.1",
 	"port": {
 	"tcp": 8080,
-	"udp": 8081
+	"udp": 8081,
+	"tls": 8443
 	},
-	"protocol": "tcp"
+	"protocol": "tcp",
+	"tls": false
 	}`
 
 	keyPair, err := datatypes.GenerateKeyPair()
@@ -136,7 +326,6 @@ func (c *Client) RejoinWhite() {
 
 func (c *Client) RejoinBlack() {
 	c.inGame = true
-	go c.awaitMove()
 }
 
 func (c *Client) getConfig(path string) string {
@@ -148,55 +337,226 @@ func (c *Client) getConfig(path string) string {
 	return value.String()
 }
 
-func (c *Client) awaitMove() {
-	c.awaitingMove = true
-	defer func() {
-		c.awaitingMove = false
-	}()
-	c.moveMutex.Lock()
-	defer c.moveMutex.Unlock()
-	c.logger.Println("Waiting for move")
+// Events returns the TLVs the server pushes without being asked: 0x81 when
+// the opponent moved, 0x80 when the game is over, MatchTag when matchmaking
+// found an opponent, DrawOfferTag and DrawDeclinedTag when the opponent
+// offered or declined a draw and ShutdownTag when the server goes away. It is
+// closed when the connection is.
+func (c *Client) Events() <-chan datatypes.TLV {
+	return c.mux.events
+}
 
-	select {
-	case <-c.moveWaitCancel:
-		return
-	default:
-		tlv, err := c.Receive()
+// readLoop is the only reader of the connection once the client is logged in.
+// It hands every response to the request waiting for it and everything else
+// to handleEvent.
+func (c *Client) readLoop() {
+	for {
+		tlv, err := c.receive()
 		if err != nil {
-			c.logger.Fatal(err)
+			c.mux.close(err)
+			return
 		}
-		err = tlv.Decrypt(c.KeyPair.PrivateKey)
+		err = c.openSession(&tlv)
 		if err != nil {
-			c.logger.Fatal(err)
+			c.logger.Println(err)
+			continue
 		}
-		verified, err := tlv.Verify(c.ServerPublicKey)
-		if err != nil || !verified {
-			c.logger.Fatal("Invalid signature")
+		if c.mux.route(tlv, c.framing == datatypes.FramingMultiplexed) {
+			continue
 		}
+		c.handleEvent(tlv)
+	}
+}
+
+// handleEvent keeps track of the game with what the server pushed and passes
+// the event on to Events.
+func (c *Client) handleEvent(tlv datatypes.TLV) {
+	err := c.unprotect(&tlv, true)
+	if err != nil {
+		c.logger.Println(err)
+		return
+	}
 
-		switch tlv.Tag {
-		case 0x80:
-			c.setConfig("inGame", "false")
-			c.inGame = false
-			val := strings.Split(string(tlv.Value[:]), ";")
-			c.setConfig("history.-1", val[0])
-			c.logger.Println("Game over")
-		case 0x81:
-			c.logger.Println("Move received")
-			val := strings.Split(string(tlv.Value[:]), ";")
-			c.logger.Println(val[0])
+	var update datatypes.BoardUpdate
+	switch tlv.Tag {
+	case 0x80:
+		c.gameOver(tlv)
+	case 0x81:
+		c.logger.Println("Move received")
+		err = update.Unmarshal(tlv.Value, c.Version())
+		if err != nil {
+			c.logger.Println(err)
+			return
+		}
+		c.logger.Println(update.Board)
+		c.logClocks(update)
+	case datatypes.MatchTag:
+		var match datatypes.Match
+		err = match.Unmarshal(tlv.Value)
+		if err != nil {
+			c.logger.Println(err)
+			return
+		}
+		c.inGame = true
+		c.setConfig("inGame", "true")
+		color := "black"
+		if match.White {
+			color = "white"
+		}
+		c.logger.Printf("Paired in %s as %s against a %d, %s", match.GameID, color, match.OpponentRating, match.TimeControl)
+	case datatypes.ShutdownTag, datatypes.DrawOfferTag, datatypes.DrawDeclinedTag:
+		var status datatypes.Status
+		err = status.Unmarshal(tlv.Value, c.Version())
+		if err != nil {
+			c.logger.Println(err)
 			return
-		default:
-			c.awaitMove()
 		}
+		c.logger.Println(status.Message)
+	default:
+		c.logger.Println("Unexpected TLV from server:", tlv.Tag)
+		return
+	}
+	c.mux.push(tlv)
+}
+
+// gameOver records the final board of a 0x80 TLV.
+func (c *Client) gameOver(tlv datatypes.TLV) {
+	c.setConfig("inGame", "false")
+	c.inGame = false
+	var update datatypes.BoardUpdate
+	err := update.Unmarshal(tlv.Value, c.Version())
+	if err != nil {
+		c.logger.Println(err)
+	} else {
+		c.setConfig("history.-1", update.Board)
+		c.logClocks(update)
+	}
+	c.logger.Println("Game over")
+	if update.RatingAfter != 0 {
+		c.logger.Printf("Rating: %d (%+d)", update.RatingAfter, update.RatingAfter-update.RatingBefore)
+	}
+}
+
+// logClocks logs the time left to both players of a timed game.
+func (c *Client) logClocks(update datatypes.BoardUpdate) {
+	if update.WhiteTime != 0 || update.BlackTime != 0 {
+		c.logger.Printf("Clocks: white %s, black %s", update.WhiteTime.Round(time.Second), update.BlackTime.Round(time.Second))
+	}
+}
+
+// Version is the protocol version agreed with the server, which payloads
+// such as the ones of Events are encoded with.
+func (c *Client) Version() uint16 {
+	if c.hello == nil {
+		return 1
+	}
+	return c.hello.Version
+}
 
-		if tlv.Tag != 0x81 {
-			c.awaitMove()
+// protect signs tlv and, when encrypt is set, RSA encrypts it for the server.
+// Once a session key exists Send seals the TLV instead, so nothing is done.
+// Servers older than the hello only know legacy signatures.
+func (c *Client) protect(tlv *datatypes.TLV, encrypt bool) error {
+	if c.cipher != nil {
+		return nil
+	}
+	var err error
+	if c.hello == nil {
+		err = tlv.SignLegacy(c.KeyPair.PrivateKey)
+	} else {
+		err = tlv.Sign(c.KeyPair.PrivateKey)
+	}
+	if err != nil {
+		return err
+	}
+	if encrypt {
+		return tlv.Encrypt(c.ServerPublicKey)
+	}
+	return nil
+}
+
+// unprotect reverses what the server did to a response: nothing left to do
+// when Receive already opened it with the session key, otherwise RSA
+// decryption when encrypted is set and signature verification.
+// The signature is stripped from the value. An error answer is returned as a
+// *datatypes.ProtocolError.
+func (c *Client) unprotect(tlv *datatypes.TLV, encrypted bool) error {
+	if c.cipher == nil {
+		// Errors are signed but never encrypted
+		if encrypted && tlv.Tag != datatypes.ErrorTag {
+			err := tlv.Decrypt(c.KeyPair.PrivateKey)
+			if err != nil {
+				return err
+			}
 		}
+		if c.hello == nil {
+			verified, err := tlv.VerifyLegacy(c.ServerPublicKey)
+			if err != nil || !verified {
+				return errors.New("Invalid signature")
+			}
+			tlv.StripLegacySignature()
+		} else {
+			verified, err := tlv.Verify(c.ServerPublicKey)
+			if err != nil || !verified {
+				return errors.New("Invalid signature")
+			}
+			tlv.StripSignature()
+		}
+	}
+	if tlv.Tag == datatypes.ErrorTag {
+		protocolErr, err := datatypes.ParseProtocolError(tlv.Value)
+		if err != nil {
+			return err
+		}
+		return protocolErr
+	}
+	return nil
+}
+
+// request sends tlv protected as described by protect and waits for readLoop
+// to hand over the answer, returned unprotected, or the error the server
+// answered with.
+func (c *Client) request(tlv datatypes.TLV, encrypt bool) (datatypes.TLV, error) {
+	if c.hello != nil && !c.hello.Supports(tlv.Tag) {
+		return tlv, ErrUnsupportedCommand
+	}
+	multiplexed := c.framing == datatypes.FramingMultiplexed
+	if !multiplexed {
+		c.mux.serial.Lock()
+		defer c.mux.serial.Unlock()
+	}
+	id, responses, err := c.mux.register()
+	if err != nil {
+		return tlv, err
 	}
+	if multiplexed {
+		tlv.ID = id
+	}
+
+	err = c.protect(&tlv, encrypt)
+	if err == nil {
+		err = c.Send(tlv)
+	}
+	if err != nil {
+		c.mux.unregister(id)
+		return tlv, err
+	}
+	r := <-responses
+	if r.err != nil {
+		return r.tlv, r.err
+	}
+	tlv = r.tlv
+	err = c.unprotect(&tlv, encrypt)
+	return tlv, err
 }
 
 func (c *Client) Send(message datatypes.TLV) error {
+	if c.compression {
+		datatypes.Compress(&message)
+	}
+	if c.cipher != nil && datatypes.IsSessionTag(message.Tag) {
+		c.cipher.Seal(&message)
+	}
 	if c.mode == "tcp" {
 		return c.SendTCP(message)
 	} else {
@@ -205,7 +565,7 @@ func (c *Client) Send(message datatypes.TLV) error {
 }
 
 func (c *Client) SendTCP(message datatypes.TLV) error {
-	_, err := c.conn.Write(message.Encode())
+	_, err := c.conn.Write(message.EncodeFramed(c.framing))
 	if err != nil {
 		return err
 	}
@@ -213,55 +573,118 @@ func (c *Client) SendTCP(message datatypes.TLV) error {
 }
 
 func (c *Client) SendUDP(message datatypes.TLV) error {
-	_, err := c.connUDP.Write(message.Encode())
+	if c.udpReliable != nil {
+		return c.udpReliable.Send(message.EncodeFramed(c.framing))
+	}
+	_, err := c.connUDP.Write(message.EncodeFramed(c.framing))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// Receive reads the next TLV from the server. Once logged in, readLoop is the
+// one reading and Receive must not be used.
 func (c *Client) Receive() (datatypes.TLV, error) {
+	tlv, err := c.receive()
+	if err != nil {
+		return tlv, err
+	}
+	return tlv, c.openSession(&tlv)
+}
+
+func (c *Client) receive() (datatypes.TLV, error) {
 	if c.mode == "tcp" {
 		return c.ReceiveTCP()
-	} else {
-		return c.ReceiveUDP()
 	}
+	return c.ReceiveUDP()
 }
 
-func (c *Client) ReceiveTCP() (datatypes.TLV, error) {
-	reader := bufio.NewReader(c.conn)
-	line, err := reader.ReadBytes('\n')
-	if err != nil {
-		return datatypes.TLV{}, err
+// openSession opens TLVs sealed with the session key and inflates compressed
+// ones.
+func (c *Client) openSession(tlv *datatypes.TLV) error {
+	if c.cipher != nil && datatypes.IsSessionTag(tlv.Tag) {
+		err := c.cipher.Open(tlv)
+		if err != nil {
+			return err
+		}
 	}
-	r, err := datatypes.Decode(line)
-	if err != nil {
-		c.logger.Fatal(err)
+	if c.compression {
+		return datatypes.Decompress(tlv)
 	}
-	return r, nil
+	return nil
+}
+
+func (c *Client) ReceiveTCP() (datatypes.TLV, error) {
+	c.reader.Framing = c.framing
+	return c.reader.Read()
 }
 
 func (c *Client) ReceiveUDP() (datatypes.TLV, error) {
-	b := make([]byte, 1024)
-	_, err := c.connUDP.Read(b)
-	if err != nil {
-		return datatypes.TLV{}, err
+	b, ok := <-c.udpMessages
+	if !ok {
+		return datatypes.TLV{}, io.EOF
+	}
+	return datatypes.UnmarshalFramed(b, c.framing)
+}
+
+// receiveWithin is Receive with a timeout, returning errTimeout when nothing
+// arrived in time.
+func (c *Client) receiveWithin(d time.Duration) (datatypes.TLV, error) {
+	if c.mode == "tcp" {
+		c.conn.SetReadDeadline(time.Now().Add(d))
+		defer c.conn.SetReadDeadline(time.Time{})
+		tlv, err := c.ReceiveTCP()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return tlv, errTimeout
+		}
+		if err != nil {
+			return tlv, err
+		}
+		return tlv, c.openSession(&tlv)
+	}
+
+	select {
+	case b, ok := <-c.udpMessages:
+		if !ok {
+			return datatypes.TLV{}, io.EOF
+		}
+		tlv, err := datatypes.UnmarshalFramed(b, c.framing)
+		if err != nil {
+			return tlv, err
+		}
+		return tlv, c.openSession(&tlv)
+	case <-time.After(d):
+		return datatypes.TLV{}, errTimeout
 	}
-	return datatypes.Decode(b)
 }
 
 func (c *Client) Close() {
 	c.conn.Close()
+	c.connUDP.Close()
 }
 
-func (c *Client) Login(user datatypes.User) error {
+// Login proves to the server that the client holds the key of a registered
+// player and opens the session. Servers older than RegistrationVersion
+// register unknown keys at Login instead, with empty names.
+func (c *Client) Login() error {
 	if c.isLoggedIn {
 		fmt.Println("Already logged in")
 		return nil
 	}
 
-	tlv := user.CreateTLV()
-	tlv.Encode()
+	var tlv datatypes.TLV
+	if c.Version() < datatypes.RegistrationVersion {
+		user := datatypes.User{IsActive: true, PublicKey: c.KeyPair.PublicKey}
+		tlv = user.CreateTLV(c.Version())
+	} else {
+		tlv = datatypes.NewTLV(0x00, []byte{})
+		err := tlv.Sign(c.KeyPair.PrivateKey)
+		if err != nil {
+			return err
+		}
+	}
 	err := c.Send(tlv)
 	if err != nil {
 		return err
@@ -270,274 +693,401 @@ func (c *Client) Login(user datatypes.User) error {
 	if err != nil {
 		return err
 	}
+	if tlv.Tag == datatypes.ErrorTag {
+		return firstContactError(tlv)
+	}
 	if tlv.Tag != 0x03 {
 		return errors.New("Invalid response")
 	}
-	c.ServerPublicKey = string(tlv.Value[:])
+	keys, err := datatypes.ParseServerKeys(string(tlv.Value))
+	if err != nil {
+		return err
+	}
+	// Only the first contact may trust a key on its own word
+	if c.ServerPublicKey != "" && !keys.Trusts(c.ServerPublicKey) {
+		return ErrUntrustedServerKey
+	}
+	// The bundle starts with the current key, which is the one signatures
+	// are checked with
+	c.ServerPublicKey = string(tlv.Value)
 	c.setConfig("ServerPublicKey", c.ServerPublicKey)
+
+	err = c.keyExchange()
+	if err != nil {
+		return err
+	}
 	c.isLoggedIn = true
+	go c.readLoop()
+	if c.mode != "tcp" {
+		go c.keepAlive()
+	}
 	return nil
 }
 
-func (c *Client) GetAvailableGames() []uuid.UUID {
-	if !c.isLoggedIn {
-		fmt.Println("Not logged in")
-		return nil
+// Register creates the account of the client key, before Login. The server
+// decides the rating: the profile it answers with has it.
+func (c *Client) Register(firstName string, lastName string) (datatypes.User, error) {
+	if c.isLoggedIn {
+		return datatypes.User{}, ErrAlreadyLoggedIn
+	}
+	if c.Version() < datatypes.RegistrationVersion {
+		return datatypes.User{}, ErrUnsupportedCommand
 	}
 
-	tlv := datatypes.NewTLV(0x1F, []byte{})
-	tlv.Sign(c.KeyPair.PrivateKey)
-	err := c.Send(tlv)
+	user := datatypes.User{FirstName: firstName, LastName: lastName, PublicKey: c.KeyPair.PublicKey}
+	tlv := datatypes.NewTLV(datatypes.RegisterTag, user.Marshal(c.Version()))
+	err := tlv.Sign(c.KeyPair.PrivateKey)
 	if err != nil {
-		c.logger.Fatal(err)
+		return datatypes.User{}, err
+	}
+	err = c.Send(tlv)
+	if err != nil {
+		return datatypes.User{}, err
 	}
-
 	tlv, err = c.Receive()
 	if err != nil {
-		c.logger.Fatal(err)
+		return datatypes.User{}, err
+	}
+	if c.ServerPublicKey == "" {
+		// The server key comes with the first Login, nothing to check the
+		// answer with before
+		tlv.StripSignature()
+		if tlv.Tag == datatypes.ErrorTag {
+			return datatypes.User{}, firstContactError(tlv)
+		}
+	} else {
+		err = c.unprotect(&tlv, false)
+		if err != nil {
+			return datatypes.User{}, err
+		}
 	}
 	if tlv.Tag != 0x82 {
-		c.logger.Fatal("Invalid response")
-	}
-
-	verified, err := tlv.Verify(c.ServerPublicKey)
-	if err != nil || !verified {
-		c.logger.Println("Invalid signature")
-		return nil
+		return datatypes.User{}, ErrInvalidResponse
 	}
+	err = user.Unmarshal(tlv.Value, c.Version())
+	return user, err
+}
 
-	val := strings.Split(string(tlv.Value[:]), ";")
-	var games []uuid.UUID
-	for _, v := range val {
-		uuid, err := uuid.Parse(v)
-		if err != nil {
-			continue
-		}
-		games = append(games, uuid)
+// firstContactError returns the error answered to a request sent before the
+// client could know the server key.
+func firstContactError(tlv datatypes.TLV) error {
+	tlv.StripSignature()
+	protocolErr, err := datatypes.ParseProtocolError(tlv.Value)
+	if err != nil {
+		return err
 	}
-	return games
+	return protocolErr
 }
 
-func (c *Client) HostGame() {
-	if !c.isLoggedIn {
-		fmt.Println("Not logged in")
-		return
+// keyExchange agrees on a session key with the server using ephemeral X25519
+// keys authenticated by both RSA keys. Servers that do not support it left
+// it out of their hello, or never answer if they sent none, in which case
+// every message keeps being protected with RSA. A server that advertised it
+// must answer: falling back then would let anyone dropping the answer
+// downgrade the session.
+func (c *Client) keyExchange() error {
+	if c.hello != nil && !c.hello.Has(datatypes.CapSessionKey) {
+		return nil
 	}
-
-	if c.inGame {
-		fmt.Println("Already in a game")
-		return
+	ephemeral, err := datatypes.GenerateEphemeralKey()
+	if err != nil {
+		return err
 	}
-
-	tlv := datatypes.NewTLV(0x1E, []byte{})
-	tlv.Sign(c.KeyPair.PrivateKey)
-	err := c.Send(tlv)
+	tlv := datatypes.NewTLV(0x04, ephemeral.PublicKey().Bytes())
+	err = tlv.Sign(c.KeyPair.PrivateKey)
 	if err != nil {
-		c.logger.Fatal(err)
+		return err
+	}
+	err = c.Send(tlv)
+	if err != nil {
+		return err
 	}
 
-	tlv, err = c.Receive()
+	tlv, err = c.receiveWithin(negotiationTimeout)
+	if errors.Is(err, errTimeout) && c.hello == nil {
+		c.logger.Println("Server did not answer key exchange, using RSA")
+		return nil
+	}
 	if err != nil {
-		c.logger.Fatal(err)
+		return err
 	}
-	if tlv.Tag != 0x82 && tlv.Tag != 0x83 {
-		c.logger.Fatal(tlv.Tag)
+	if tlv.Tag != 0x04 || len(tlv.Value) < 2*datatypes.EphemeralKeySize {
+		return errors.New("Invalid response")
 	}
 	verified, err := tlv.Verify(c.ServerPublicKey)
 	if err != nil || !verified {
-		c.logger.Fatal("Invalid signature")
+		return errors.New("Invalid signature")
 	}
-	if tlv.Tag == 0x82 {
-		c.inGame = true
-		c.setConfig("inGame", "true")
-	} else {
-		fmt.Println("Player already in game")
+	serverPublic := tlv.Value[:datatypes.EphemeralKeySize]
+	echoed := tlv.Value[datatypes.EphemeralKeySize : 2*datatypes.EphemeralKeySize]
+	if !bytes.Equal(echoed, ephemeral.PublicKey().Bytes()) {
+		return errors.New("Key exchange answered another client key")
 	}
+
+	c.cipher, err = datatypes.NewSessionCipher(ephemeral, serverPublic, false)
+	return err
 }
 
-func (c *Client) JoinSolo() {
-	if !c.isLoggedIn {
-		fmt.Println("Not logged in")
-		return
+// keepAlive stops the server from expiring the UDP session while the player
+// waits for the opponent.
+func (c *Client) keepAlive() {
+	for {
+		time.Sleep(keepAliveInterval)
+		err := c.Send(datatypes.NewTLV(0x02, []byte{}))
+		if err != nil {
+			return
+		}
 	}
+}
 
-	if c.inGame {
-		fmt.Println("Already in a game")
-		return
+// Profile returns the profile the server keeps for the player.
+func (c *Client) Profile() (datatypes.User, error) {
+	return c.profileRequest(datatypes.NewTLV(datatypes.GetProfileTag, []byte{}))
+}
+
+// UpdateProfile changes the names of the player or deactivates the account,
+// returning the updated profile.
+func (c *Client) UpdateProfile(update datatypes.ProfileUpdate) (datatypes.User, error) {
+	return c.profileRequest(datatypes.NewTLV(datatypes.UpdateProfileTag, update.Marshal()))
+}
+
+func (c *Client) profileRequest(tlv datatypes.TLV) (datatypes.User, error) {
+	if !c.isLoggedIn {
+		return datatypes.User{}, ErrNotLoggedIn
 	}
 
-	tlv := datatypes.NewTLV(0x1D, []byte{})
-	tlv.Sign(c.KeyPair.PrivateKey)
-	err := c.Send(tlv)
+	tlv, err := c.request(tlv, false)
 	if err != nil {
-		c.logger.Fatal(err)
+		return datatypes.User{}, err
+	}
+	if tlv.Tag != 0x82 {
+		return datatypes.User{}, ErrInvalidResponse
 	}
 
-	tlv, err = c.Receive()
-	if err != nil {
-		c.logger.Fatal(err)
+	var user datatypes.User
+	err = user.Unmarshal(tlv.Value, c.Version())
+	return user, err
+}
+
+// JoinQueue asks matchmaking for an opponent rated at most ratingRange away,
+// 0 for the server default, to play with timeControl. The pairing comes as a
+// MatchTag event.
+func (c *Client) JoinQueue(timeControl datatypes.TimeControl, ratingRange int) error {
+	request := datatypes.QueueRequest{TimeControl: timeControl, RatingRange: ratingRange}
+	return c.queueRequest(datatypes.NewTLV(datatypes.JoinQueueTag, request.Marshal()))
+}
+
+func (c *Client) LeaveQueue() error {
+	return c.queueRequest(datatypes.NewTLV(datatypes.LeaveQueueTag, []byte{}))
+}
+
+func (c *Client) queueRequest(tlv datatypes.TLV) error {
+	if !c.isLoggedIn {
+		return ErrNotLoggedIn
 	}
-	if tlv.Tag != 0x82 && tlv.Tag != 0x83 {
-		c.logger.Fatal(tlv.Tag)
+	if c.inGame {
+		return ErrAlreadyInGame
 	}
-	verified, err := tlv.Verify(c.ServerPublicKey)
-	if err != nil || !verified {
-		c.logger.Fatal("Invalid signature")
+
+	tlv, err := c.request(tlv, false)
+	if err != nil {
+		return err
 	}
-	if tlv.Tag == 0x82 {
-		c.inGame = true
-		c.setConfig("inGame", "true")
-	} else {
-		fmt.Println("Player already in game")
+	if tlv.Tag != 0x82 {
+		return ErrInvalidResponse
 	}
+	return nil
 }
 
-func (c *Client) JoinGame(gameID uuid.UUID) {
+func (c *Client) GetAvailableGames() ([]uuid.UUID, error) {
 	if !c.isLoggedIn {
-		fmt.Println("Not logged in")
-		return
+		return nil, ErrNotLoggedIn
 	}
 
-	if c.inGame {
-		fmt.Println("Already in a game")
-		return
+	tlv, err := c.request(datatypes.NewTLV(0x1F, []byte{}), false)
+	if err != nil {
+		return nil, err
+	}
+	if tlv.Tag != 0x82 {
+		return nil, ErrInvalidResponse
 	}
 
-	tlv := datatypes.NewTLV(0x20, []byte(gameID.String()+";"))
-	tlv.Sign(c.KeyPair.PrivateKey)
-	err := c.Send(tlv)
+	var games datatypes.GameList
+	err = games.Unmarshal(tlv.Value, c.Version())
 	if err != nil {
-		c.logger.Fatal(err)
+		return nil, err
 	}
+	return games.GameIDs, nil
+}
 
-	tlv, err = c.Receive()
+// HostGame hosts a game with timeControl for another player to join. The
+// clock of a timed game starts when they join.
+func (c *Client) HostGame(timeControl datatypes.TimeControl) error {
+	request := datatypes.HostRequest{TimeControl: timeControl}
+	return c.createGame(datatypes.NewTLV(0x1E, request.Marshal()))
+}
+
+func (c *Client) JoinSolo() error {
+	return c.createGame(datatypes.NewTLV(0x1D, []byte{}))
+}
+
+func (c *Client) createGame(request datatypes.TLV) error {
+	if !c.isLoggedIn {
+		return ErrNotLoggedIn
+	}
+
+	if c.inGame {
+		return ErrAlreadyInGame
+	}
+
+	tlv, err := c.request(request, false)
 	if err != nil {
-		c.logger.Fatal(err)
+		return err
 	}
 	if tlv.Tag != 0x82 {
-		c.logger.Fatal("Invalid response")
-	}
-	verified, err := tlv.Verify(c.ServerPublicKey)
-	if err != nil || !verified {
-		c.logger.Fatal("Invalid signature")
+		return ErrInvalidResponse
 	}
 	c.inGame = true
 	c.setConfig("inGame", "true")
-	go c.awaitMove()
+	return nil
 }
 
-func (c *Client) PlayMove(move string) {
+func (c *Client) JoinGame(gameID uuid.UUID) error {
 	if !c.isLoggedIn {
-		fmt.Println("Not logged in")
-		return
+		return ErrNotLoggedIn
 	}
 
-	if !c.inGame {
-		fmt.Println("Not in a game")
-		return
+	if c.inGame {
+		return ErrAlreadyInGame
 	}
 
-	if c.awaitingMove {
-		fmt.Println("Awaiting move")
-		return
+	request := datatypes.GameReference{GameID: gameID}
+	tlv, err := c.request(datatypes.NewTLV(0x20, request.Marshal(c.Version())), false)
+	if err != nil {
+		return err
 	}
+	if tlv.Tag != 0x82 {
+		return ErrInvalidResponse
+	}
+	c.inGame = true
+	c.setConfig("inGame", "true")
+	return nil
+}
 
-	c.moveMutex.Lock()
-	defer c.moveMutex.Unlock()
-
-	tlv := datatypes.NewTLV(0x21, []byte(move))
-	tlv.Sign(c.KeyPair.PrivateKey)
-	tlv.Encrypt(c.ServerPublicKey)
-	err := c.Send(tlv)
-	if err != nil {
-		c.logger.Fatal(err)
+func (c *Client) PlayMove(move string) error {
+	if !c.isLoggedIn {
+		return ErrNotLoggedIn
 	}
 
-	tlv, err = c.Receive()
-	tlv.Decrypt(c.KeyPair.PrivateKey)
-	if err != nil {
-		c.logger.Fatal(err)
+	if !c.inGame {
+		return ErrNotInGame
 	}
 
-	verified, err := tlv.Verify(c.ServerPublicKey)
-	if err != nil || !verified {
-		c.logger.Fatal("Invalid signature")
+	request := datatypes.MoveRequest{Move: move}
+	tlv, err := c.request(datatypes.NewTLV(0x21, request.Marshal(c.Version())), true)
+	if err != nil {
+		return err
 	}
 
 	switch tlv.Tag {
 	case 0x80:
-		c.setConfig("inGame", "false")
-		c.inGame = false
-		val := strings.Split(string(tlv.Value[:]), ";")
-		c.setConfig("history.-1", val[0])
-		c.logger.Println("Game over")
-		close(c.moveWaitCancel)
-		return
+		c.gameOver(tlv)
 	case 0x82:
 		c.logger.Println("Move accepted")
-	case 0x83:
-		c.logger.Println("Move rejected")
-		c.awaitingMove = false
+	default:
+		return ErrInvalidResponse
 	}
-
-	go c.awaitMove()
+	return nil
 }
 
-func (c *Client) GetAvailableMoves() []string {
-	close(c.moveWaitCancel)
-	c.moveWaitCancel = make(chan struct{})
-	c.moveMutex.Lock()
-	defer c.moveMutex.Unlock()
-
-	var moves []string
+func (c *Client) GetAvailableMoves() ([]string, error) {
 	if !c.isLoggedIn {
-		fmt.Println("Not logged in")
-		return nil
+		return nil, ErrNotLoggedIn
 	}
 
 	if !c.inGame {
-		fmt.Println("Not in a game")
-		return nil
+		return nil, ErrNotInGame
 	}
 
-	tlv := datatypes.NewTLV(0x22, []byte{})
-	tlv.Sign(c.KeyPair.PrivateKey)
-	tlv.Encrypt(c.ServerPublicKey)
-	err := c.Send(tlv)
+	tlv, err := c.request(datatypes.NewTLV(0x22, []byte{}), true)
 	if err != nil {
-		c.logger.Fatal(err)
+		return nil, err
+	}
+	if tlv.Tag != 0x82 {
+		return nil, ErrInvalidResponse
 	}
 
-	tlv, err = c.Receive()
+	var moves datatypes.MoveList
+	err = moves.Unmarshal(tlv.Value, c.Version())
 	if err != nil {
-		c.logger.Fatal(err)
+		return nil, err
 	}
-	tlv.Decrypt(c.KeyPair.PrivateKey)
-	verified, err := tlv.Verify(c.ServerPublicKey)
-	if err != nil || !verified {
-		c.logger.Fatal("Invalid signature")
+	return moves.Moves, nil
+}
+
+// Resign gives up the game.
+func (c *Client) Resign() error {
+	return c.endGameRequest(datatypes.NewTLV(datatypes.ResignTag, []byte{}))
+}
+
+// OfferDraw offers a draw to the opponent, who gets a DrawOfferTag event. The
+// game ends with a 0x80 event if they accept, a DrawDeclinedTag event comes
+// if they decline. When the opponent offered a draw first, the game ends
+// right away.
+func (c *Client) OfferDraw() error {
+	return c.endGameRequest(datatypes.NewTLV(datatypes.OfferDrawTag, []byte{}))
+}
+
+// AnswerDraw accepts or declines the draw the opponent offered.
+func (c *Client) AnswerDraw(accept bool) error {
+	answer := datatypes.DrawAnswer{Accept: accept}
+	return c.endGameRequest(datatypes.NewTLV(datatypes.AnswerDrawTag, answer.Marshal()))
+}
+
+// ClaimDraw draws the game by reason, which the position must allow.
+func (c *Client) ClaimDraw(reason datatypes.DrawReason) error {
+	claim := datatypes.DrawClaim{Reason: reason}
+	return c.endGameRequest(datatypes.NewTLV(datatypes.ClaimDrawTag, claim.Marshal()))
+}
+
+// endGameRequest sends a request that may end the game, which the server
+// answers with the final board when it does.
+func (c *Client) endGameRequest(tlv datatypes.TLV) error {
+	if !c.isLoggedIn {
+		return ErrNotLoggedIn
+	}
+	if !c.inGame {
+		return ErrNotInGame
 	}
 
-	val := strings.Split(string(tlv.Value[:]), ";")
-	nbMoves, err := strconv.Atoi(val[0])
+	tlv, err := c.request(tlv, true)
 	if err != nil {
-		c.logger.Fatal(err)
+		return err
 	}
-	for i := 1; i < nbMoves; i++ {
-		moves = append(moves, val[i])
+	switch tlv.Tag {
+	case 0x80:
+		c.gameOver(tlv)
+	case 0x82:
+		var status datatypes.Status
+		err = status.Unmarshal(tlv.Value, c.Version())
+		if err != nil {
+			return err
+		}
+		c.logger.Println(status.Message)
+	default:
+		return ErrInvalidResponse
 	}
-
-	go c.awaitMove()
-
-	return moves
+	return nil
 }
 
 func (c *Client) CLI() {
 	var items []string
 	if !c.isLoggedIn {
+		items = append(items, "Register")
 		items = append(items, "Login")
 	} else {
 		if !c.inGame {
+			items = append(items, "Find opponent")
 			items = append(items, "Host game")
 			items = append(items, "Join solo")
 			items = append(items, "Join game")
@@ -545,7 +1095,12 @@ func (c *Client) CLI() {
 		} else {
 			items = append(items, "Play move")
 			items = append(items, "Get available moves")
+			items = append(items, "Offer draw")
+			items = append(items, "Answer draw offer")
+			items = append(items, "Claim draw")
+			items = append(items, "Resign")
 		}
+		items = append(items, "Profile")
 		items = append(items, "Quit")
 	}
 	prompt := promptui.Select{
@@ -559,13 +1114,27 @@ func (c *Client) CLI() {
 	}
 
 	switch result {
+	case "Register":
+		c.registerCLI()
 	case "Login":
-		c.loginCLI()
+		err = c.Login()
+		if err != nil {
+			fmt.Println(err)
+		}
+		c.CLI()
+	case "Find opponent":
+		c.findOpponentCLI()
 	case "Host game":
-		c.HostGame()
+		err = c.HostGame(c.timeControlCLI("-"))
+		if err != nil {
+			fmt.Println(err)
+		}
 		c.CLI()
 	case "Join solo":
-		c.JoinSolo()
+		err = c.JoinSolo()
+		if err != nil {
+			fmt.Println(err)
+		}
 		c.CLI()
 	case "Join game":
 		c.joinGameCLI()
@@ -575,17 +1144,30 @@ func (c *Client) CLI() {
 		c.playMoveCLI()
 	case "Get available moves":
 		c.getAvailableMovesCLI()
+	case "Offer draw":
+		err = c.OfferDraw()
+		if err != nil {
+			fmt.Println(err)
+		}
+		c.CLI()
+	case "Answer draw offer":
+		c.answerDrawCLI()
+	case "Claim draw":
+		c.claimDrawCLI()
+	case "Resign":
+		err = c.Resign()
+		if err != nil {
+			fmt.Println(err)
+		}
+		c.CLI()
+	case "Profile":
+		c.profileCLI()
 	case "Quit":
 		c.Close()
 	}
 }
 
-func (c *Client) loginCLI() {
-	if c.isLoggedIn {
-		fmt.Println("Already logged in")
-		return
-	}
-
+func (c *Client) registerCLI() {
 	firstNamePrompt := promptui.Prompt{
 		Label: "First name",
 	}
@@ -602,29 +1184,50 @@ func (c *Client) loginCLI() {
 		c.logger.Fatal(err)
 	}
 
-	eloPrompt := promptui.Prompt{
-		Label: "Elo",
-		Validate: func(s string) error {
-			_, err := strconv.Atoi(s)
-			if err != nil {
-				return errors.New("Invalid number")
-			}
-			return nil
-		},
+	user, err := c.Register(firstName, lastName)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Println("Registered with rating", user.Elo)
 	}
-	elo, err := eloPrompt.Run()
+	c.CLI()
+}
+
+func (c *Client) findOpponentCLI() {
+	err := c.JoinQueue(c.timeControlCLI("5+3"), 0)
 	if err != nil {
-		c.logger.Fatal(err)
+		fmt.Println(err)
+	} else {
+		fmt.Println("Waiting for an opponent")
 	}
-	eloInt, err := strconv.Atoi(elo)
+	c.CLI()
+}
+
+// timeControlCLI prompts for a time control, def by default.
+func (c *Client) timeControlCLI(def string) datatypes.TimeControl {
+	timeControlPrompt := promptui.Prompt{
+		Label:   "Time control (5+3, 5d2 delay, 3 days or - for none)",
+		Default: def,
+		Validate: func(s string) error {
+			_, err := datatypes.ParseTimeControl(s)
+			return err
+		},
+	}
+	result, err := timeControlPrompt.Run()
 	if err != nil {
 		c.logger.Fatal(err)
 	}
+	timeControl, _ := datatypes.ParseTimeControl(result)
+	return timeControl
+}
 
-	user := datatypes.NewUser(firstName, lastName, true, eloInt, c.KeyPair.PublicKey)
-	err = c.Login(*user)
+func (c *Client) profileCLI() {
+	user, err := c.Profile()
 	if err != nil {
-		c.logger.Fatal(err)
+		fmt.Println(err)
+	} else {
+		fmt.Println(user.FirstName, user.LastName)
+		fmt.Println("Rating:", user.Elo)
 	}
 	c.CLI()
 }
@@ -647,7 +1250,10 @@ func (c *Client) joinGameCLI() {
 		c.logger.Fatal(err)
 	}
 
-	c.JoinGame(gameIDUUID)
+	err = c.JoinGame(gameIDUUID)
+	if err != nil {
+		fmt.Println(err)
+	}
 }
 
 func (c *Client) getAvailableGamesCLI() {
@@ -656,7 +1262,12 @@ func (c *Client) getAvailableGamesCLI() {
 		return
 	}
 
-	games := c.GetAvailableGames()
+	games, err := c.GetAvailableGames()
+	if err != nil {
+		fmt.Println(err)
+		c.CLI()
+		return
+	}
 	gamesID := make([]string, len(games))
 	for _, game := range games {
 		gamesID = append(gamesID, game.String())
@@ -677,7 +1288,45 @@ func (c *Client) getAvailableGamesCLI() {
 		c.logger.Fatal(err)
 	}
 
-	c.JoinGame(gameID)
+	err = c.JoinGame(gameID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	c.CLI()
+}
+
+func (c *Client) answerDrawCLI() {
+	prompt := promptui.Select{
+		Label: "Draw offered",
+		Items: []string{"Accept", "Decline"},
+	}
+	_, result, err := prompt.Run()
+	if err != nil {
+		c.logger.Fatal(err)
+	}
+
+	err = c.AnswerDraw(result == "Accept")
+	if err != nil {
+		fmt.Println(err)
+	}
+	c.CLI()
+}
+
+func (c *Client) claimDrawCLI() {
+	reasons := []datatypes.DrawReason{datatypes.ThreefoldRepetition, datatypes.FiftyMoveRule}
+	prompt := promptui.Select{
+		Label: "Claim a draw by",
+		Items: reasons,
+	}
+	i, _, err := prompt.Run()
+	if err != nil {
+		c.logger.Fatal(err)
+	}
+
+	err = c.ClaimDraw(reasons[i])
+	if err != nil {
+		fmt.Println(err)
+	}
 	c.CLI()
 }
 
@@ -692,11 +1341,6 @@ func (c *Client) playMoveCLI() {
 		return
 	}
 
-	if c.awaitingMove {
-		fmt.Println("Awaiting move")
-		c.CLI()
-	}
-
 	movePrompt := promptui.Prompt{
 		Label: "Move",
 	}
@@ -705,7 +1349,10 @@ func (c *Client) playMoveCLI() {
 		c.logger.Fatal(err)
 	}
 
-	c.PlayMove(move)
+	err = c.PlayMove(move)
+	if err != nil {
+		fmt.Println(err)
+	}
 	c.CLI()
 }
 
@@ -720,12 +1367,12 @@ func (c *Client) getAvailableMovesCLI() {
 		return
 	}
 
-	if c.awaitingMove {
-		fmt.Println("Awaiting move")
+	moves, err := c.GetAvailableMoves()
+	if err != nil {
+		fmt.Println(err)
 		c.CLI()
+		return
 	}
-
-	moves := c.GetAvailableMoves()
 	fmt.Println("Available moves:")
 	for _, move := range moves {
 		fmt.Println(move)
@@ -746,6 +1393,9 @@ func (c *Client) getAvailableMovesCLI() {
 		c.logger.Fatal(err)
 	}
 
-	c.PlayMove(result)
+	err = c.PlayMove(result)
+	if err != nil {
+		fmt.Println(err)
+	}
 	c.CLI()
 }
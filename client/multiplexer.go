@@ -0,0 +1,107 @@
+package client
+
+import (
+	"reseau2TP2/datatypes"
+	"sync"
+)
+
+// response is what readLoop hands to the request waiting for it.
+type response struct {
+	tlv datatypes.TLV
+	err error
+}
+
+// multiplexer routes what the server sends once the client is logged in.
+// Every request waits on its own channel, filed under its request ID, while
+// the events the server pushes on its own (opponent moves, game over) go to
+// the events channel.
+//
+// Without FramingMultiplexed there are no IDs, so requests are sent one at a
+// time and anything but an opponent move or a shutdown notice answers the
+// pending request.
+type multiplexer struct {
+	mutex   sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan response
+	// err is set once the connection is gone
+	err error
+
+	// serial is held during a whole request when the framing has no IDs
+	serial sync.Mutex
+	events chan datatypes.TLV
+}
+
+func newMultiplexer() *multiplexer {
+	return &multiplexer{
+		pending: make(map[uint32]chan response),
+		events:  make(chan datatypes.TLV, 64),
+	}
+}
+
+// register reserves a request ID and the channel its response arrives on.
+func (m *multiplexer) register() (uint32, chan response, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.err != nil {
+		return 0, nil, m.err
+	}
+	m.nextID++
+	// 0 is the ID of events
+	if m.nextID == 0 {
+		m.nextID++
+	}
+	responses := make(chan response, 1)
+	m.pending[m.nextID] = responses
+	return m.nextID, responses, nil
+}
+
+func (m *multiplexer) unregister(id uint32) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.pending, id)
+}
+
+// route hands tlv to the request it answers and reports whether there was one.
+func (m *multiplexer) route(tlv datatypes.TLV, multiplexed bool) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	id := tlv.ID
+	if !multiplexed {
+		switch tlv.Tag {
+		case 0x81, datatypes.ShutdownTag, datatypes.MatchTag, datatypes.DrawOfferTag, datatypes.DrawDeclinedTag:
+			return false
+		}
+		for pendingID := range m.pending {
+			id = pendingID
+		}
+	}
+	responses, exists := m.pending[id]
+	if !exists {
+		return false
+	}
+	delete(m.pending, id)
+	responses <- response{tlv: tlv}
+	return true
+}
+
+// push queues an event. Events nobody reads are dropped rather than blocking
+// the responses behind them.
+func (m *multiplexer) push(tlv datatypes.TLV) {
+	select {
+	case m.events <- tlv:
+	default:
+	}
+}
+
+// close fails every pending request with err, as well as every later one.
+func (m *multiplexer) close(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.err = err
+	for id, responses := range m.pending {
+		responses <- response{err: err}
+		delete(m.pending, id)
+	}
+	close(m.events)
+}
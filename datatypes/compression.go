@@ -0,0 +1,63 @@
+package datatypes
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+// Once CapCompression is agreed every value starts with one of these.
+const (
+	valueStored   byte = 0
+	valueDeflated byte = 1
+)
+
+// Smaller values rarely shrink enough to be worth it
+const compressionThreshold = 256
+
+// Compress deflates the value when it is large enough and gets smaller, and
+// prefixes it with how it is stored. It is applied before sealing with the
+// session key, after signing and RSA encryption.
+func Compress(t *TLV) {
+	if len(t.Value) >= compressionThreshold {
+		var b bytes.Buffer
+		b.WriteByte(valueDeflated)
+		w, _ := flate.NewWriter(&b, flate.DefaultCompression)
+		w.Write(t.Value)
+		w.Close()
+		if b.Len() < len(t.Value)+1 {
+			t.Value = b.Bytes()
+			t.Length = len(t.Value)
+			return
+		}
+	}
+	t.Value = append([]byte{valueStored}, t.Value...)
+	t.Length = len(t.Value)
+}
+
+func Decompress(t *TLV) error {
+	if len(t.Value) == 0 {
+		return errors.New("compressed value too short")
+	}
+	switch t.Value[0] {
+	case valueStored:
+		t.Value = t.Value[1:]
+	case valueDeflated:
+		r := flate.NewReader(bytes.NewReader(t.Value[1:]))
+		defer r.Close()
+		// Bounded like the framing so a small value cannot inflate forever
+		value, err := io.ReadAll(io.LimitReader(r, maxLength+1))
+		if err != nil {
+			return err
+		}
+		if len(value) > maxLength {
+			return errors.New("TLV length exceeds maximum")
+		}
+		t.Value = value
+	default:
+		return errors.New("unknown value compression")
+	}
+	t.Length = len(t.Value)
+	return nil
+}
@@ -0,0 +1,96 @@
+package datatypes
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrorTag is the tag of the TLV answering a request that failed.
+const ErrorTag uint8 = 0x84
+
+type ErrorCode uint16
+
+const (
+	CodeInternal ErrorCode = iota + 1
+	CodeMalformedRequest
+	CodeUnknownCommand
+	CodeInvalidSignature
+	CodeStaleRequest
+	CodeReplayedRequest
+	CodeUnknownGame
+	CodeAlreadyInGame
+	CodeNotInGame
+	CodeNotYourTurn
+	CodeInvalidMove
+	CodeUnknownUser
+	CodeAlreadyRegistered
+	CodeInactiveUser
+	CodeNoDrawOffer
+	CodeDrawNotClaimable
+	CodeGameNotJoinable
+	CodeDrawNotOfferable
+)
+
+// ProtocolError is the content of an error TLV: a code, the tag of the
+// request it answers and a human readable message.
+type ProtocolError struct {
+	Code       ErrorCode
+	RequestTag uint8
+	Message    string
+}
+
+// Sentinels to compare protocol errors with errors.Is, only the code matters.
+var (
+	ErrInternal          = &ProtocolError{Code: CodeInternal}
+	ErrMalformedRequest  = &ProtocolError{Code: CodeMalformedRequest}
+	ErrUnknownCommand    = &ProtocolError{Code: CodeUnknownCommand}
+	ErrInvalidSignature  = &ProtocolError{Code: CodeInvalidSignature}
+	ErrStaleRequest      = &ProtocolError{Code: CodeStaleRequest}
+	ErrReplayedRequest   = &ProtocolError{Code: CodeReplayedRequest}
+	ErrUnknownGame       = &ProtocolError{Code: CodeUnknownGame}
+	ErrAlreadyInGame     = &ProtocolError{Code: CodeAlreadyInGame}
+	ErrNotInGame         = &ProtocolError{Code: CodeNotInGame}
+	ErrNotYourTurn       = &ProtocolError{Code: CodeNotYourTurn}
+	ErrInvalidMove       = &ProtocolError{Code: CodeInvalidMove}
+	ErrUnknownUser       = &ProtocolError{Code: CodeUnknownUser}
+	ErrAlreadyRegistered = &ProtocolError{Code: CodeAlreadyRegistered}
+	ErrInactiveUser      = &ProtocolError{Code: CodeInactiveUser}
+	ErrNoDrawOffer       = &ProtocolError{Code: CodeNoDrawOffer}
+	ErrDrawNotClaimable  = &ProtocolError{Code: CodeDrawNotClaimable}
+	ErrGameNotJoinable   = &ProtocolError{Code: CodeGameNotJoinable}
+	ErrDrawNotOfferable  = &ProtocolError{Code: CodeDrawNotOfferable}
+)
+
+func NewProtocolError(code ErrorCode, requestTag uint8, message string) *ProtocolError {
+	return &ProtocolError{Code: code, RequestTag: requestTag, Message: message}
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("request 0x%02X failed (code %d): %s", e.RequestTag, e.Code, e.Message)
+}
+
+func (e *ProtocolError) Is(target error) bool {
+	t, ok := target.(*ProtocolError)
+	return ok && t.Code == e.Code
+}
+
+// TLV encodes the error as code (2 bytes), request tag (1 byte) and message.
+func (e *ProtocolError) TLV() TLV {
+	v := make([]byte, 3, 3+len(e.Message))
+	binary.BigEndian.PutUint16(v, uint16(e.Code))
+	v[2] = e.RequestTag
+	v = append(v, e.Message...)
+	return NewTLV(ErrorTag, v)
+}
+
+func ParseProtocolError(value []byte) (*ProtocolError, error) {
+	if len(value) < 3 {
+		return nil, errors.New("error TLV too short")
+	}
+	return &ProtocolError{
+		Code:       ErrorCode(binary.BigEndian.Uint16(value)),
+		RequestTag: value[2],
+		Message:    string(value[3:]),
+	}, nil
+}
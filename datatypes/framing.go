@@ -0,0 +1,222 @@
+package datatypes
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+type Framing uint8
+
+const (
+	// FramingLegacy escapes newlines in the value and terminates every TLV
+	// with '\n'. Peers that never negotiate keep using it.
+	FramingLegacy Framing = iota
+	// FramingBinary relies only on the length header, so values are sent
+	// untouched. Values of 0xFFFF bytes or more set the 2-byte length to
+	// 0xFFFF and follow it with the real length as a uvarint.
+	FramingBinary
+	// FramingMultiplexed is binary framing with the TLV ID, 4 bytes, between
+	// the tag and the length, so responses can be matched to their request.
+	FramingMultiplexed
+)
+
+const extendedLength = 0xFFFF
+
+// maxLength bounds the extended length so a corrupted header cannot make the
+// reader allocate arbitrary amounts of memory.
+const maxLength = 16 << 20
+
+// Values exchanged in the 0x01 framing negotiation.
+const (
+	FramingBinaryName      = "binary"
+	FramingMultiplexedName = "multiplexed"
+)
+
+const idSize = 4
+
+func (f Framing) String() string {
+	switch f {
+	case FramingBinary:
+		return FramingBinaryName
+	case FramingMultiplexed:
+		return FramingMultiplexedName
+	}
+	return "legacy"
+}
+
+// ParseFraming returns the framing named name, legacy for unknown names.
+func ParseFraming(name string) Framing {
+	switch name {
+	case FramingBinaryName:
+		return FramingBinary
+	case FramingMultiplexedName:
+		return FramingMultiplexed
+	}
+	return FramingLegacy
+}
+
+func (f Framing) hasID() bool {
+	return f == FramingMultiplexed
+}
+
+// Marshal encodes the TLV using binary framing. Unlike Encode it does not
+// modify the value.
+func (t *TLV) Marshal() []byte {
+	return t.marshal(false)
+}
+
+func (t *TLV) marshal(withID bool) []byte {
+	t.Length = len(t.Value)
+	b := make([]byte, 0, 3+idSize+binary.MaxVarintLen64+len(t.Value))
+	b = append(b, t.Tag)
+	if withID {
+		b = binary.BigEndian.AppendUint32(b, t.ID)
+	}
+	if t.Length < extendedLength {
+		b = append(b, byte(t.Length>>8), byte(t.Length))
+	} else {
+		b = append(b, 0xFF, 0xFF)
+		b = binary.AppendUvarint(b, uint64(t.Length))
+	}
+	return append(b, t.Value...)
+}
+
+// EncodeFramed encodes the TLV with the given framing.
+func (t *TLV) EncodeFramed(f Framing) []byte {
+	if f == FramingLegacy {
+		return t.Encode()
+	}
+	return t.marshal(f.hasID())
+}
+
+// Unmarshal decodes one binary framed TLV from b and returns the number of
+// bytes consumed.
+func Unmarshal(b []byte) (TLV, int, error) {
+	return unmarshal(b, false)
+}
+
+func unmarshal(b []byte, withID bool) (TLV, int, error) {
+	var id uint32
+	if withID {
+		if len(b) < 1+idSize {
+			return TLV{}, 0, errors.New("byte slice too short to decode TLV")
+		}
+		id = binary.BigEndian.Uint32(b[1:])
+		// The rest parses like a binary framed TLV
+		b = append([]byte{b[0]}, b[1+idSize:]...)
+	}
+	if len(b) < 3 {
+		return TLV{}, 0, errors.New("byte slice too short to decode TLV")
+	}
+	header := 3
+	length := int(b[1])<<8 | int(b[2])
+	if length == extendedLength {
+		l, n := binary.Uvarint(b[3:])
+		if n <= 0 {
+			return TLV{}, 0, errors.New("invalid extended length")
+		}
+		if l > maxLength {
+			return TLV{}, 0, errors.New("TLV length exceeds maximum")
+		}
+		header += n
+		length = int(l)
+	}
+	if len(b)-header < length {
+		return TLV{}, 0, errors.New("insufficient bytes for specified length")
+	}
+	value := make([]byte, length)
+	copy(value, b[header:header+length])
+	if withID {
+		header += idSize
+	}
+	return TLV{Tag: b[0], ID: id, Length: length, Value: value}, header + length, nil
+}
+
+// UnmarshalFramed decodes a message holding exactly one TLV with the given
+// framing, such as a reliable UDP message once the framing was negotiated.
+func UnmarshalFramed(b []byte, f Framing) (TLV, error) {
+	if f == FramingLegacy {
+		if len(b) == 0 || b[len(b)-1] != '\n' {
+			return TLV{}, errors.New("legacy TLV not terminated by a newline")
+		}
+		return Decode(b[:len(b)-1])
+	}
+	tlv, n, err := unmarshal(b, f.hasID())
+	if err != nil {
+		return TLV{}, err
+	}
+	if n != len(b) {
+		return TLV{}, errors.New("message size does not match TLV length")
+	}
+	return tlv, nil
+}
+
+// DecodeDatagram decodes a TLV carried in a single datagram. Datagrams keep
+// their boundaries, so the framing is told apart by size: a legacy TLV is one
+// byte longer than its header announces because of the trailing newline.
+func DecodeDatagram(b []byte) (TLV, Framing, error) {
+	tlv, n, err := Unmarshal(b)
+	if err != nil {
+		return TLV{}, FramingLegacy, err
+	}
+	if n == len(b) {
+		return tlv, FramingBinary, nil
+	}
+	if n+1 == len(b) && b[n] == '\n' {
+		tlv, err = Decode(b[:n])
+		return tlv, FramingLegacy, err
+	}
+	return TLV{}, FramingLegacy, errors.New("datagram size does not match TLV length")
+}
+
+// FrameReader reads TLVs from a stream, replacing bufio.ReadBytes('\n').
+// Framing can be changed between reads once both peers agreed on it.
+type FrameReader struct {
+	r       *bufio.Reader
+	Framing Framing
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r)}
+}
+
+func (fr *FrameReader) Read() (TLV, error) {
+	if fr.Framing == FramingLegacy {
+		line, err := fr.r.ReadBytes('\n')
+		if err != nil {
+			return TLV{}, err
+		}
+		return Decode(line[:len(line)-1])
+	}
+
+	header := make([]byte, 3)
+	var id uint32
+	if fr.Framing.hasID() {
+		header = make([]byte, 3+idSize)
+	}
+	if _, err := io.ReadFull(fr.r, header); err != nil {
+		return TLV{}, err
+	}
+	if fr.Framing.hasID() {
+		id = binary.BigEndian.Uint32(header[1:])
+		header = append(header[:1], header[1+idSize:]...)
+	}
+	length := int(header[1])<<8 | int(header[2])
+	if length == extendedLength {
+		l, err := binary.ReadUvarint(fr.r)
+		if err != nil {
+			return TLV{}, err
+		}
+		if l > maxLength {
+			return TLV{}, errors.New("TLV length exceeds maximum")
+		}
+		length = int(l)
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(fr.r, value); err != nil {
+		return TLV{}, err
+	}
+	return TLV{Tag: header[0], ID: id, Length: length, Value: value}, nil
+}
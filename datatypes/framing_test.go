@@ -0,0 +1,46 @@
+package datatypes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestFrameReaderExtendedLength(t *testing.T) {
+	for _, framing := range []Framing{FramingBinary, FramingMultiplexed} {
+		var stream bytes.Buffer
+		want := []TLV{
+			NewTLV(0x80, bytes.Repeat([]byte("a"), extendedLength-1)),
+			NewTLV(0x81, bytes.Repeat([]byte("b"), extendedLength)),
+			NewTLV(0x82, bytes.Repeat([]byte("c"), 3*extendedLength)),
+		}
+		for i := range want {
+			want[i].ID = uint32(i + 1)
+			stream.Write(want[i].EncodeFramed(framing))
+		}
+
+		fr := NewFrameReader(&stream)
+		fr.Framing = framing
+		for _, w := range want {
+			got, err := fr.Read()
+			if err != nil {
+				t.Fatalf("%v: Read: %v", framing, err)
+			}
+			if got.Tag != w.Tag || got.Length != len(w.Value) || !bytes.Equal(got.Value, w.Value) {
+				t.Errorf("%v: read tag %#x with %d bytes, want tag %#x with %d", framing, got.Tag, len(got.Value), w.Tag, len(w.Value))
+			}
+			if framing.hasID() && got.ID != w.ID {
+				t.Errorf("%v: read ID %d, want %d", framing, got.ID, w.ID)
+			}
+		}
+	}
+}
+
+func TestFrameReaderRejectsOversizedLength(t *testing.T) {
+	header := binary.AppendUvarint([]byte{0x80, 0xFF, 0xFF}, maxLength+1)
+	fr := NewFrameReader(bytes.NewReader(header))
+	fr.Framing = FramingBinary
+	if _, err := fr.Read(); err == nil {
+		t.Error("read a TLV longer than maxLength")
+	}
+}
@@ -0,0 +1,93 @@
+package datatypes
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+// HelloTag is the tag of the hello exchanged before Login.
+const HelloTag uint8 = 0x05
+
+// ProtocolVersion is the version of the TLV protocol spoken by this code.
+// Peers that never send a hello speak version 1.
+const ProtocolVersion uint16 = 4
+
+type Capabilities uint32
+
+const (
+	CapFramingBinary Capabilities = 1 << iota
+	CapFramingMultiplexed
+	// CapCompression deflates large values, see Compress
+	CapCompression
+	// CapSessionKey is the X25519 key exchange followed by AES-GCM, without
+	// it every TLV is protected with RSA
+	CapSessionKey
+)
+
+// SupportedCapabilities is everything this code knows how to do.
+const SupportedCapabilities = CapFramingBinary | CapFramingMultiplexed | CapCompression | CapSessionKey
+
+// Hello describes what a peer speaks. The client sends its own, the server
+// answers with the version and capabilities both agreed on. Commands are the
+// tags the sender accepts.
+type Hello struct {
+	Version      uint16
+	Capabilities Capabilities
+	Commands     []uint8
+}
+
+// TLV encodes the hello as version (2 bytes), capabilities (4 bytes) and one
+// byte per command.
+func (h Hello) TLV() TLV {
+	v := make([]byte, 6, 6+len(h.Commands))
+	binary.BigEndian.PutUint16(v, h.Version)
+	binary.BigEndian.PutUint32(v[2:], uint32(h.Capabilities))
+	v = append(v, h.Commands...)
+	return NewTLV(HelloTag, v)
+}
+
+func ParseHello(value []byte) (Hello, error) {
+	if len(value) < 6 {
+		return Hello{}, errors.New("hello TLV too short")
+	}
+	return Hello{
+		Version:      binary.BigEndian.Uint16(value),
+		Capabilities: Capabilities(binary.BigEndian.Uint32(value[2:])),
+		Commands:     append([]uint8{}, value[6:]...),
+	}, nil
+}
+
+// Negotiate returns the hello answering peer: the lowest of both versions and
+// the capabilities both support, with h's commands.
+func (h Hello) Negotiate(peer Hello) Hello {
+	agreed := Hello{
+		Version:      min(h.Version, peer.Version),
+		Capabilities: h.Capabilities & peer.Capabilities,
+		Commands:     h.Commands,
+	}
+	// Legacy framing escapes newlines, which compressed values cannot afford
+	if agreed.Framing() == FramingLegacy {
+		agreed.Capabilities &^= CapCompression
+	}
+	return agreed
+}
+
+// Framing is the best framing the capabilities allow.
+func (h Hello) Framing() Framing {
+	switch {
+	case h.Capabilities&CapFramingMultiplexed != 0:
+		return FramingMultiplexed
+	case h.Capabilities&CapFramingBinary != 0:
+		return FramingBinary
+	}
+	return FramingLegacy
+}
+
+func (h Hello) Has(capability Capabilities) bool {
+	return h.Capabilities&capability != 0
+}
+
+func (h Hello) Supports(command uint8) bool {
+	return slices.Contains(h.Commands, command)
+}
@@ -0,0 +1,51 @@
+package datatypes
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// Headers of a request to the HTTP API signed with a player's key. They play
+// the part of the signature trailer of a TLV.
+const (
+	HeaderKeyID     = "X-Key-ID"
+	HeaderTimestamp = "X-Timestamp"
+	HeaderNonce     = "X-Nonce"
+	HeaderSignature = "X-Signature"
+)
+
+// SignedRequestMessage is what the signature of an HTTP request covers: the
+// method, the path, the timestamp and nonce of the headers and the body, one
+// per line.
+func SignedRequestMessage(method string, path string, timestamp string, nonce string, body []byte) []byte {
+	message := []byte(method + "\n" + path + "\n" + timestamp + "\n" + nonce + "\n")
+	return append(message, body...)
+}
+
+// SignRequestHeaders returns the headers authenticating an HTTP request made
+// with keyPair, so scripts written in Go do not have to build them.
+func SignRequestHeaders(keyPair KeyPair, method string, path string, body []byte) (map[string]string, error) {
+	keyID, err := KeyIDOf(keyPair.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+	signature, err := SignMessage(keyPair.PrivateKey, SignedRequestMessage(method, path, timestamp, nonceHex, body))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		HeaderKeyID:     keyID.String(),
+		HeaderTimestamp: timestamp,
+		HeaderNonce:     nonceHex,
+		HeaderSignature: base64.StdEncoding.EncodeToString(signature),
+	}, nil
+}
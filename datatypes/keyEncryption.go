@@ -0,0 +1,105 @@
+package datatypes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"golang.org/x/crypto/pbkdf2"
+	"strconv"
+)
+
+// keyEncryptionIterations is the PBKDF2 cost of deriving the key that
+// protects a private key at rest.
+const keyEncryptionIterations = 600000
+
+const encryptedPrefix = "ENCRYPTED "
+
+var ErrWrongPassphrase = errors.New("Wrong passphrase")
+
+// EncryptPEM protects a PEM block with a passphrase: AES-256-GCM with a key
+// derived by PBKDF2-SHA256. The salt, the iteration count and the nonce go in
+// the headers of the returned block, the other headers are kept as is.
+func EncryptPEM(block *pem.Block, passphrase string) (*pem.Block, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := passphraseAEAD(passphrase, salt, keyEncryptionIterations)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]string)
+	for k, v := range block.Headers {
+		headers[k] = v
+	}
+	headers["Salt"] = base64.StdEncoding.EncodeToString(salt)
+	headers["Iterations"] = strconv.Itoa(keyEncryptionIterations)
+	headers["Nonce"] = base64.StdEncoding.EncodeToString(nonce)
+	return &pem.Block{
+		Type:    encryptedPrefix + block.Type,
+		Headers: headers,
+		Bytes:   aead.Seal(nil, nonce, block.Bytes, []byte(block.Type)),
+	}, nil
+}
+
+// IsEncryptedPEM tells whether block was made by EncryptPEM.
+func IsEncryptedPEM(block *pem.Block) bool {
+	return len(block.Type) > len(encryptedPrefix) && block.Type[:len(encryptedPrefix)] == encryptedPrefix
+}
+
+// DecryptPEM reverses EncryptPEM.
+func DecryptPEM(block *pem.Block, passphrase string) (*pem.Block, error) {
+	if !IsEncryptedPEM(block) {
+		return nil, errors.New("PEM block is not encrypted")
+	}
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, err
+	}
+	iterations, err := strconv.Atoi(block.Headers["Iterations"])
+	if err != nil || iterations < 1 {
+		return nil, errors.New("invalid iteration count")
+	}
+	aead, err := passphraseAEAD(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+
+	typ := block.Type[len(encryptedPrefix):]
+	plain, err := aead.Open(nil, nonce, block.Bytes, []byte(typ))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	headers := make(map[string]string)
+	for k, v := range block.Headers {
+		if k != "Salt" && k != "Iterations" && k != "Nonce" {
+			headers[k] = v
+		}
+	}
+	return &pem.Block{Type: typ, Headers: headers, Bytes: plain}, nil
+}
+
+func passphraseAEAD(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key := pbkdf2.Key([]byte(passphrase), salt, iterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -6,7 +6,9 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	_ "strings"
 )
 
@@ -44,19 +46,82 @@ func GenerateKeyPair() (KeyPair, error) {
 	}, nil
 }
 
-func VerifySignature(signature []byte, key string) bool {
-	block, _ := pem.Decode([]byte(key))
+// KeyID is a short fingerprint of a public key, carried in signatures so the
+// verifier knows which key to check them against.
+type KeyID [8]byte
+
+func (id KeyID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// KeyIDOf returns the fingerprint of a PEM encoded public key: the first
+// bytes of the SHA-256 of its DER encoding.
+func KeyIDOf(publicKey string) (KeyID, error) {
+	block, _ := pem.Decode([]byte(publicKey))
 	if block == nil {
-		return false
+		return KeyID{}, errors.New("failed to decode public key")
 	}
-	parsedKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	return keyIDOfDER(block.Bytes), nil
+}
+
+// ParseKeyID parses the hex form returned by String.
+func ParseKeyID(s string) (KeyID, error) {
+	var id KeyID
+	b, err := hex.DecodeString(s)
 	if err != nil {
-		return false
+		return id, err
+	}
+	if len(b) != len(id) {
+		return id, errors.New("invalid key ID length")
 	}
-	hashed := sha256.Sum256(signature[:len(signature)-256-1])
-	err = rsa.VerifyPKCS1v15(parsedKey.(*rsa.PublicKey), crypto.SHA256, hashed[:], signature[len(signature)-256:])
+	copy(id[:], b)
+	return id, nil
+}
+
+// SignMessage signs message with a PEM private key, for transports that do
+// not carry TLVs such as the HTTP API.
+func SignMessage(privateKey string, message []byte) ([]byte, error) {
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return nil, errors.New("Failed to decode private key")
+	}
+	parsedKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 	if err != nil {
-		return false
+		return nil, err
 	}
-	return true
+	hashed := sha256.Sum256(message)
+	return rsa.SignPKCS1v15(rand.Reader, parsedKey, crypto.SHA256, hashed[:])
+}
+
+// VerifyMessage checks a signature made by SignMessage.
+func VerifyMessage(publicKey string, message []byte, signature []byte) error {
+	rsaKey, err := parseRSAPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256(message)
+	return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hashed[:], signature)
+}
+
+func parseRSAPublicKey(publicKey string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return nil, errors.New("Failed to decode public key")
+	}
+	parsedKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := parsedKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return rsaKey, nil
+}
+
+func keyIDOfDER(der []byte) KeyID {
+	var id KeyID
+	sum := sha256.Sum256(der)
+	copy(id[:], sum[:])
+	return id
 }
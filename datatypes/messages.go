@@ -0,0 +1,455 @@
+package datatypes
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Payloads of the requests and responses. Marshal and Unmarshal take the
+// protocol version agreed with the peer: typed fields from
+// TypedPayloadVersion on, the historical semicolon separated strings before.
+
+// GameReference names a game: the game to join, or the game created or
+// joined in the answer.
+type GameReference struct {
+	GameID uuid.UUID
+}
+
+const gameReferenceID uint8 = 1
+
+func (m GameReference) Marshal(version uint16) []byte {
+	if version < TypedPayloadVersion {
+		return []byte(m.GameID.String())
+	}
+	var f fields
+	f.add(gameReferenceID, m.GameID[:])
+	return f.b
+}
+
+func (m *GameReference) Unmarshal(b []byte, version uint16) error {
+	var err error
+	if version < TypedPayloadVersion {
+		m.GameID, err = uuid.Parse(strings.Split(string(b), ";")[0])
+		return err
+	}
+	return parseFields(b, func(field uint8, value []byte) error {
+		if field == gameReferenceID {
+			m.GameID, err = uuid.FromBytes(value)
+		}
+		return err
+	})
+}
+
+// GameList answers GetAvailableGames.
+type GameList struct {
+	GameIDs []uuid.UUID
+}
+
+const gameListGameID uint8 = 1
+
+func (m GameList) Marshal(version uint16) []byte {
+	if version < TypedPayloadVersion {
+		var gameIDs string
+		for _, gameID := range m.GameIDs {
+			gameIDs += gameID.String() + ";"
+		}
+		return []byte(gameIDs)
+	}
+	var f fields
+	for _, gameID := range m.GameIDs {
+		f.add(gameListGameID, gameID[:])
+	}
+	return f.b
+}
+
+func (m *GameList) Unmarshal(b []byte, version uint16) error {
+	m.GameIDs = nil
+	if version < TypedPayloadVersion {
+		for _, v := range strings.Split(string(b), ";") {
+			if v == "" {
+				continue
+			}
+			gameID, err := uuid.Parse(v)
+			if err != nil {
+				return err
+			}
+			m.GameIDs = append(m.GameIDs, gameID)
+		}
+		return nil
+	}
+	return parseFields(b, func(field uint8, value []byte) error {
+		if field != gameListGameID {
+			return nil
+		}
+		gameID, err := uuid.FromBytes(value)
+		if err != nil {
+			return err
+		}
+		m.GameIDs = append(m.GameIDs, gameID)
+		return nil
+	})
+}
+
+// MoveRequest is a move in algebraic notation, like "Nf3".
+type MoveRequest struct {
+	Move string
+}
+
+const moveRequestMove uint8 = 1
+
+func (m MoveRequest) Marshal(version uint16) []byte {
+	if version < TypedPayloadVersion {
+		return []byte(m.Move)
+	}
+	var f fields
+	f.addString(moveRequestMove, m.Move)
+	return f.b
+}
+
+func (m *MoveRequest) Unmarshal(b []byte, version uint16) error {
+	if version < TypedPayloadVersion {
+		m.Move = strings.Split(string(b), ";")[0]
+		return nil
+	}
+	return parseFields(b, func(field uint8, value []byte) error {
+		if field == moveRequestMove {
+			m.Move = string(value)
+		}
+		return nil
+	})
+}
+
+// MoveList answers GetAvailableMoves.
+type MoveList struct {
+	Moves []string
+}
+
+const moveListMove uint8 = 1
+
+func (m MoveList) Marshal(version uint16) []byte {
+	if version < TypedPayloadVersion {
+		return []byte(strconv.Itoa(len(m.Moves)) + ";" + strings.Join(m.Moves, ";"))
+	}
+	var f fields
+	for _, move := range m.Moves {
+		f.addString(moveListMove, move)
+	}
+	return f.b
+}
+
+func (m *MoveList) Unmarshal(b []byte, version uint16) error {
+	m.Moves = nil
+	if version < TypedPayloadVersion {
+		val := strings.Split(string(b), ";")
+		nbMoves, err := strconv.Atoi(val[0])
+		if err != nil {
+			return err
+		}
+		if nbMoves > len(val)-1 {
+			return errors.New("move list shorter than its count")
+		}
+		m.Moves = val[1 : nbMoves+1]
+		return nil
+	}
+	return parseFields(b, func(field uint8, value []byte) error {
+		if field == moveListMove {
+			m.Moves = append(m.Moves, string(value))
+		}
+		return nil
+	})
+}
+
+// BoardUpdate is the board after a move, sent when the opponent moved and
+// when the game is over. When a rated game is over it also carries the
+// rating of the receiver before and after the game, and in timed games the
+// time left on both clocks. These are 0 otherwise, and always before
+// TypedPayloadVersion.
+type BoardUpdate struct {
+	Board        string
+	RatingBefore int
+	RatingAfter  int
+	WhiteTime    time.Duration
+	BlackTime    time.Duration
+}
+
+const (
+	boardUpdateBoard        uint8 = 1
+	boardUpdateRatingBefore uint8 = 2
+	boardUpdateRatingAfter  uint8 = 3
+	// clocks are in milliseconds
+	boardUpdateWhiteTime uint8 = 4
+	boardUpdateBlackTime uint8 = 5
+)
+
+func (m BoardUpdate) Marshal(version uint16) []byte {
+	if version < TypedPayloadVersion {
+		return []byte(m.Board)
+	}
+	var f fields
+	f.addString(boardUpdateBoard, m.Board)
+	if m.RatingAfter != 0 {
+		f.addInt(boardUpdateRatingBefore, int64(m.RatingBefore))
+		f.addInt(boardUpdateRatingAfter, int64(m.RatingAfter))
+	}
+	if m.WhiteTime != 0 || m.BlackTime != 0 {
+		f.addInt(boardUpdateWhiteTime, m.WhiteTime.Milliseconds())
+		f.addInt(boardUpdateBlackTime, m.BlackTime.Milliseconds())
+	}
+	return f.b
+}
+
+func (m *BoardUpdate) Unmarshal(b []byte, version uint16) error {
+	if version < TypedPayloadVersion {
+		m.Board = string(b)
+		return nil
+	}
+	return parseFields(b, func(field uint8, value []byte) error {
+		if field == boardUpdateBoard {
+			m.Board = string(value)
+			return nil
+		}
+		v, err := fieldInt(value)
+		if err != nil {
+			return err
+		}
+		switch field {
+		case boardUpdateRatingBefore:
+			m.RatingBefore = int(v)
+		case boardUpdateRatingAfter:
+			m.RatingAfter = int(v)
+		case boardUpdateWhiteTime:
+			m.WhiteTime = time.Duration(v) * time.Millisecond
+		case boardUpdateBlackTime:
+			m.BlackTime = time.Duration(v) * time.Millisecond
+		}
+		return nil
+	})
+}
+
+// ShutdownTag is pushed with a Status to the players connected when the
+// server shuts down, to peers that announced it in their hello.
+const ShutdownTag uint8 = 0x88
+
+// Status is a plain confirmation, like a move being accepted.
+type Status struct {
+	Message string
+}
+
+const statusMessage uint8 = 1
+
+func (m Status) Marshal(version uint16) []byte {
+	if version < TypedPayloadVersion {
+		return []byte(m.Message)
+	}
+	var f fields
+	f.addString(statusMessage, m.Message)
+	return f.b
+}
+
+func (m *Status) Unmarshal(b []byte, version uint16) error {
+	if version < TypedPayloadVersion {
+		m.Message = string(b)
+		return nil
+	}
+	return parseFields(b, func(field uint8, value []byte) error {
+		if field == statusMessage {
+			m.Message = string(value)
+		}
+		return nil
+	})
+}
+
+// HostRequest hosts a game with TimeControl. An empty request, as sent by
+// clients older than timed games, hosts an untimed game.
+type HostRequest struct {
+	TimeControl TimeControl
+}
+
+const hostRequestTimeControl uint8 = 1
+
+func (m HostRequest) Marshal() []byte {
+	var f fields
+	f.addString(hostRequestTimeControl, m.TimeControl.String())
+	return f.b
+}
+
+func (m *HostRequest) Unmarshal(b []byte) error {
+	return parseFields(b, func(field uint8, value []byte) error {
+		var err error
+		if field == hostRequestTimeControl {
+			m.TimeControl, err = ParseTimeControl(string(value))
+		}
+		return err
+	})
+}
+
+// Tags of matchmaking. JoinQueue and LeaveQueue are requests; MatchTag is
+// pushed with a Match to both players when they are paired.
+const (
+	JoinQueueTag  uint8 = 0x25
+	LeaveQueueTag uint8 = 0x26
+	MatchTag      uint8 = 0x85
+)
+
+// QueueRequest enters the matchmaking queue for a game with TimeControl
+// against an opponent rated at most RatingRange away, 0 for the server
+// default. Matchmaking came after typed payloads, so it is always typed.
+type QueueRequest struct {
+	TimeControl TimeControl
+	RatingRange int
+}
+
+const (
+	queueRequestTimeControl uint8 = iota + 1
+	queueRequestRatingRange
+)
+
+func (m QueueRequest) Marshal() []byte {
+	var f fields
+	f.addString(queueRequestTimeControl, m.TimeControl.String())
+	f.addInt(queueRequestRatingRange, int64(m.RatingRange))
+	return f.b
+}
+
+func (m *QueueRequest) Unmarshal(b []byte) error {
+	return parseFields(b, func(field uint8, value []byte) error {
+		var err error
+		switch field {
+		case queueRequestTimeControl:
+			m.TimeControl, err = ParseTimeControl(string(value))
+		case queueRequestRatingRange:
+			var ratingRange int64
+			ratingRange, err = fieldInt(value)
+			m.RatingRange = int(ratingRange)
+		}
+		return err
+	})
+}
+
+// Match is the game a player was paired into by matchmaking.
+type Match struct {
+	GameID         uuid.UUID
+	White          bool
+	OpponentRating int
+	TimeControl    TimeControl
+}
+
+const (
+	matchGameID uint8 = iota + 1
+	matchWhite
+	matchOpponentRating
+	matchTimeControl
+)
+
+func (m Match) Marshal() []byte {
+	var f fields
+	f.add(matchGameID, m.GameID[:])
+	f.addBool(matchWhite, m.White)
+	f.addInt(matchOpponentRating, int64(m.OpponentRating))
+	f.addString(matchTimeControl, m.TimeControl.String())
+	return f.b
+}
+
+func (m *Match) Unmarshal(b []byte) error {
+	return parseFields(b, func(field uint8, value []byte) error {
+		var err error
+		switch field {
+		case matchGameID:
+			m.GameID, err = uuid.FromBytes(value)
+		case matchWhite:
+			m.White, err = fieldBool(value)
+		case matchOpponentRating:
+			var rating int64
+			rating, err = fieldInt(value)
+			m.OpponentRating = int(rating)
+		case matchTimeControl:
+			m.TimeControl, err = ParseTimeControl(string(value))
+		}
+		return err
+	})
+}
+
+// Tags of ending a game other than by a move. Resign, OfferDraw, AnswerDraw
+// and ClaimDraw are requests, answered with 0x80 when they end the game.
+// DrawOfferTag is pushed with a Status to the opponent of a player offering a
+// draw, and DrawDeclinedTag back to that player when it is declined.
+const (
+	ResignTag       uint8 = 0x27
+	OfferDrawTag    uint8 = 0x28
+	AnswerDrawTag   uint8 = 0x29
+	ClaimDrawTag    uint8 = 0x2A
+	DrawOfferTag    uint8 = 0x86
+	DrawDeclinedTag uint8 = 0x87
+)
+
+// DrawAnswer accepts or declines the draw offered by the opponent. Like
+// matchmaking, game endings are always typed.
+type DrawAnswer struct {
+	Accept bool
+}
+
+const drawAnswerAccept uint8 = 1
+
+func (m DrawAnswer) Marshal() []byte {
+	var f fields
+	f.addBool(drawAnswerAccept, m.Accept)
+	return f.b
+}
+
+func (m *DrawAnswer) Unmarshal(b []byte) error {
+	return parseFields(b, func(field uint8, value []byte) error {
+		var err error
+		if field == drawAnswerAccept {
+			m.Accept, err = fieldBool(value)
+		}
+		return err
+	})
+}
+
+// DrawReason is a rule by which a player may claim a draw without the
+// agreement of their opponent.
+type DrawReason uint8
+
+const (
+	ThreefoldRepetition DrawReason = iota + 1
+	FiftyMoveRule
+)
+
+func (r DrawReason) String() string {
+	switch r {
+	case ThreefoldRepetition:
+		return "threefold repetition"
+	case FiftyMoveRule:
+		return "fifty-move rule"
+	default:
+		return "unknown"
+	}
+}
+
+// DrawClaim claims a draw by Reason.
+type DrawClaim struct {
+	Reason DrawReason
+}
+
+const drawClaimReason uint8 = 1
+
+func (m DrawClaim) Marshal() []byte {
+	var f fields
+	f.addInt(drawClaimReason, int64(m.Reason))
+	return f.b
+}
+
+func (m *DrawClaim) Unmarshal(b []byte) error {
+	return parseFields(b, func(field uint8, value []byte) error {
+		if field != drawClaimReason {
+			return nil
+		}
+		reason, err := fieldInt(value)
+		m.Reason = DrawReason(reason)
+		return err
+	})
+}
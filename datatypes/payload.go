@@ -0,0 +1,76 @@
+package datatypes
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// TypedPayloadVersion is the first protocol version whose payloads are typed
+// fields instead of semicolon separated strings. Messages keep both encodings
+// and pick one from the version agreed in the hello.
+const TypedPayloadVersion uint16 = 3
+
+var errMalformedPayload = errors.New("malformed payload")
+
+// fields builds a typed payload: a sequence of fields, each a field number
+// (1 byte), a uvarint length and the value. A field holding a message is that
+// message's payload, repeated fields appear once per element. Readers skip
+// fields they do not know, so messages can grow without breaking older peers.
+type fields struct {
+	b []byte
+}
+
+func (f *fields) add(field uint8, value []byte) {
+	f.b = append(f.b, field)
+	f.b = binary.AppendUvarint(f.b, uint64(len(value)))
+	f.b = append(f.b, value...)
+}
+
+func (f *fields) addString(field uint8, value string) {
+	f.add(field, []byte(value))
+}
+
+func (f *fields) addInt(field uint8, value int64) {
+	f.add(field, binary.AppendVarint(nil, value))
+}
+
+func (f *fields) addBool(field uint8, value bool) {
+	if value {
+		f.add(field, []byte{1})
+	} else {
+		f.add(field, []byte{0})
+	}
+}
+
+// parseFields calls fn with every field of the payload b, in order.
+func parseFields(b []byte, fn func(field uint8, value []byte) error) error {
+	for len(b) > 0 {
+		field := b[0]
+		length, n := binary.Uvarint(b[1:])
+		if n <= 0 || length > uint64(len(b)-1-n) {
+			return errMalformedPayload
+		}
+		value := b[1+n : 1+n+int(length)]
+		b = b[1+n+int(length):]
+		err := fn(field, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fieldInt(value []byte) (int64, error) {
+	v, n := binary.Varint(value)
+	if n != len(value) {
+		return 0, errMalformedPayload
+	}
+	return v, nil
+}
+
+func fieldBool(value []byte) (bool, error) {
+	if len(value) != 1 {
+		return false, errMalformedPayload
+	}
+	return value[0] != 0, nil
+}
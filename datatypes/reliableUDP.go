@@ -0,0 +1,349 @@
+package datatypes
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Reliable UDP packets start with one of these kinds, which never collide
+// with a TLV tag, so plain datagrams from older peers can still be told apart.
+const (
+	reliableData byte = 0xD0
+	reliableAck  byte = 0xD1
+)
+
+const (
+	// kind, epoch, sequence number, fragment index, fragment count
+	reliableHeaderSize = 1 + 4 + 4 + 2 + 2
+	// Keeps every datagram below the usual path MTU
+	reliableFragmentSize = 1200
+	// No message is larger than maxLength
+	reliableMaxFragments = (maxLength + reliableFragmentSize - 1) / reliableFragmentSize
+	// reliableWindow is how far ahead of the next message to deliver a
+	// fragment may be, reliableMaxReassemblies how many messages may be
+	// partly received at once and reliableMaxBuffered how many bytes of
+	// messages other than the next one may be held. They bound what a peer
+	// can make us buffer.
+	reliableWindow          = 256
+	reliableMaxReassemblies = 16
+	reliableMaxBuffered     = maxLength
+
+	retransmitInterval = 50 * time.Millisecond
+	initialTimeout     = 200 * time.Millisecond
+	maxTimeout         = 2 * time.Second
+	maxRetransmits     = 8
+	reassemblyTimeout  = 30 * time.Second
+)
+
+type fragmentID struct {
+	seq   uint32
+	index uint16
+}
+
+type outgoingFragment struct {
+	packet  []byte
+	sentAt  time.Time
+	timeout time.Duration
+	retries int
+}
+
+type reassembly struct {
+	fragments [][]byte
+	received  int
+	size      int
+	updated   time.Time
+}
+
+// ReliableUDP adds sequencing, acknowledgements, retransmission, duplicate
+// suppression and fragmentation on top of an unreliable datagram writer for
+// a single peer. Messages are delivered in the order they were sent.
+//
+// Every endpoint picks a random epoch when it is created. A receiver seeing
+// a new epoch knows the peer restarted and resets its sequence tracking.
+type ReliableUDP struct {
+	write func([]byte) error
+
+	mutex   sync.Mutex
+	epoch   uint32
+	nextSeq uint32
+	unacked map[fragmentID]*outgoingFragment
+
+	peerEpoch   uint32
+	expectedSeq uint32
+	partial     map[uint32]*reassembly
+	complete    map[uint32][]byte
+	gapSince    time.Time
+	// buffered is the size of the fragments in partial and complete
+	buffered int
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewReliableUDP(write func([]byte) error) *ReliableUDP {
+	var epoch [4]byte
+	rand.Read(epoch[:])
+	r := &ReliableUDP{
+		write:    write,
+		epoch:    binary.BigEndian.Uint32(epoch[:]),
+		nextSeq:  1,
+		unacked:  make(map[fragmentID]*outgoingFragment),
+		partial:  make(map[uint32]*reassembly),
+		complete: make(map[uint32][]byte),
+		done:     make(chan struct{}),
+	}
+	go r.retransmitLoop()
+	return r
+}
+
+// IsReliableDatagram reports whether b was produced by a ReliableUDP endpoint.
+func IsReliableDatagram(b []byte) bool {
+	return len(b) > 0 && (b[0] == reliableData || b[0] == reliableAck)
+}
+
+// Send fragments msg and sends every fragment. It does not wait for the
+// acknowledgements; unacknowledged fragments are retransmitted in the
+// background until the peer acknowledges them or the retry budget runs out.
+func (r *ReliableUDP) Send(msg []byte) error {
+	if len(msg) > maxLength {
+		return errors.New("message too large for reliable UDP")
+	}
+	count := (len(msg) + reliableFragmentSize - 1) / reliableFragmentSize
+	if count == 0 {
+		count = 1
+	}
+
+	r.mutex.Lock()
+	seq := r.nextSeq
+	r.nextSeq++
+	var packets [][]byte
+	for i := 0; i < count; i++ {
+		end := (i + 1) * reliableFragmentSize
+		if end > len(msg) {
+			end = len(msg)
+		}
+		packet := r.header(reliableData, r.epoch, seq, uint16(i), uint16(count))
+		packet = append(packet, msg[i*reliableFragmentSize:end]...)
+		r.unacked[fragmentID{seq, uint16(i)}] = &outgoingFragment{
+			packet:  packet,
+			sentAt:  time.Now(),
+			timeout: initialTimeout,
+		}
+		packets = append(packets, packet)
+	}
+	r.mutex.Unlock()
+
+	for _, packet := range packets {
+		err := r.write(packet)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Receive processes one datagram and returns the messages it completed, in
+// sending order. Acknowledgements are sent for every data fragment, including
+// duplicates, since the previous acknowledgement may have been lost.
+func (r *ReliableUDP) Receive(b []byte) ([][]byte, error) {
+	if len(b) < reliableHeaderSize || !IsReliableDatagram(b) {
+		return nil, errors.New("not a reliable UDP datagram")
+	}
+	kind := b[0]
+	epoch := binary.BigEndian.Uint32(b[1:5])
+	seq := binary.BigEndian.Uint32(b[5:9])
+	index := binary.BigEndian.Uint16(b[9:11])
+	count := binary.BigEndian.Uint16(b[11:13])
+
+	if kind == reliableAck {
+		r.mutex.Lock()
+		if epoch == r.epoch {
+			delete(r.unacked, fragmentID{seq, index})
+		}
+		r.mutex.Unlock()
+		return nil, nil
+	}
+
+	if count == 0 || index >= count || count > reliableMaxFragments {
+		return nil, errors.New("invalid fragment header")
+	}
+	// Send cuts every fragment but the last one to reliableFragmentSize
+	payload := b[reliableHeaderSize:]
+	if len(payload) > reliableFragmentSize || index < count-1 && len(payload) != reliableFragmentSize {
+		return nil, errors.New("invalid fragment size")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if epoch != r.peerEpoch {
+		r.peerEpoch = epoch
+		r.expectedSeq = 1
+		r.partial = make(map[uint32]*reassembly)
+		r.complete = make(map[uint32][]byte)
+		r.gapSince = time.Time{}
+		r.buffered = 0
+	}
+
+	// Fragments refused here are not acknowledged, so the peer sends them
+	// again once there is room.
+	if seq >= r.expectedSeq+reliableWindow {
+		return nil, errors.New("fragment too far ahead")
+	}
+	delivered := seq < r.expectedSeq || r.complete[seq] != nil
+	part, exists := r.partial[seq]
+	if exists && int(count) != len(part.fragments) {
+		return nil, errors.New("fragment count mismatch")
+	}
+	// The next message to deliver always gets through, the ones after it
+	// share reliableMaxBuffered
+	stored := delivered || exists && part.fragments[index] != nil
+	if !stored && seq != r.expectedSeq && r.buffered+len(payload) > reliableMaxBuffered {
+		return nil, errors.New("too much data buffered")
+	}
+	if !delivered && !exists && len(r.partial) >= reliableMaxReassemblies {
+		// Make room by dropping the message furthest ahead, so the ones
+		// due next always get through
+		furthest := seq
+		for pending := range r.partial {
+			furthest = max(furthest, pending)
+		}
+		if furthest == seq {
+			return nil, errors.New("too many messages being reassembled")
+		}
+		r.dropPartial(furthest)
+	}
+
+	err := r.write(r.header(reliableAck, epoch, seq, index, count))
+	if err != nil {
+		return nil, err
+	}
+	// Already delivered or already reassembled
+	if delivered {
+		return nil, nil
+	}
+
+	if !exists {
+		part = &reassembly{fragments: make([][]byte, count)}
+		r.partial[seq] = part
+	}
+	part.updated = time.Now()
+	if !stored {
+		part.fragments[index] = append([]byte{}, payload...)
+		part.received++
+		part.size += len(payload)
+		r.buffered += len(payload)
+	}
+	if part.received < len(part.fragments) {
+		return nil, nil
+	}
+	if part.size > maxLength {
+		r.dropPartial(seq)
+		return nil, errors.New("message too large")
+	}
+
+	var msg []byte
+	for _, fragment := range part.fragments {
+		msg = append(msg, fragment...)
+	}
+	delete(r.partial, seq)
+	r.complete[seq] = msg
+
+	// A message the peer gave up on leaves a hole that would block every
+	// following message, so skip it once it has been missing long enough.
+	if _, ok := r.complete[r.expectedSeq]; !ok {
+		if r.gapSince.IsZero() {
+			r.gapSince = time.Now()
+		} else if time.Since(r.gapSince) > reassemblyTimeout {
+			var oldest uint32
+			for pending := range r.complete {
+				if oldest == 0 || pending < oldest {
+					oldest = pending
+				}
+			}
+			r.expectedSeq = oldest
+		}
+	}
+
+	var messages [][]byte
+	for {
+		next, ok := r.complete[r.expectedSeq]
+		if !ok {
+			break
+		}
+		delete(r.complete, r.expectedSeq)
+		r.buffered -= len(next)
+		r.expectedSeq++
+		r.gapSince = time.Time{}
+		messages = append(messages, next)
+	}
+	return messages, nil
+}
+
+// Close stops the retransmissions. Pending fragments are dropped.
+func (r *ReliableUDP) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+}
+
+// dropPartial gives up on reassembling seq. r.mutex must be held.
+func (r *ReliableUDP) dropPartial(seq uint32) {
+	r.buffered -= r.partial[seq].size
+	delete(r.partial, seq)
+}
+
+func (r *ReliableUDP) header(kind byte, epoch uint32, seq uint32, index uint16, count uint16) []byte {
+	b := make([]byte, reliableHeaderSize, reliableHeaderSize+reliableFragmentSize)
+	b[0] = kind
+	binary.BigEndian.PutUint32(b[1:5], epoch)
+	binary.BigEndian.PutUint32(b[5:9], seq)
+	binary.BigEndian.PutUint16(b[9:11], index)
+	binary.BigEndian.PutUint16(b[11:13], count)
+	return b
+}
+
+func (r *ReliableUDP) retransmitLoop() {
+	ticker := time.NewTicker(retransmitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			var packets [][]byte
+			r.mutex.Lock()
+			for id, fragment := range r.unacked {
+				if now.Sub(fragment.sentAt) < fragment.timeout {
+					continue
+				}
+				if fragment.retries >= maxRetransmits {
+					log.Printf("Giving up on message %d fragment %d\n", id.seq, id.index)
+					delete(r.unacked, id)
+					continue
+				}
+				fragment.retries++
+				fragment.sentAt = now
+				fragment.timeout = min(fragment.timeout*2, maxTimeout)
+				packets = append(packets, fragment.packet)
+			}
+			for seq, part := range r.partial {
+				if now.Sub(part.updated) > reassemblyTimeout {
+					r.dropPartial(seq)
+				}
+			}
+			r.mutex.Unlock()
+
+			for _, packet := range packets {
+				err := r.write(packet)
+				if err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package datatypes
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// reliablePair returns a sender whose datagrams are collected instead of
+// sent, and a receiver whose acknowledgements are collected likewise.
+func reliablePair(t *testing.T) (sender *ReliableUDP, sent *[][]byte, receiver *ReliableUDP, acks *[][]byte) {
+	sent, acks = &[][]byte{}, &[][]byte{}
+	sender = NewReliableUDP(func(b []byte) error {
+		*sent = append(*sent, b)
+		return nil
+	})
+	receiver = NewReliableUDP(func(b []byte) error {
+		*acks = append(*acks, b)
+		return nil
+	})
+	t.Cleanup(sender.Close)
+	t.Cleanup(receiver.Close)
+	return sender, sent, receiver, acks
+}
+
+// receiveAll feeds datagrams to r and returns the messages they completed.
+func receiveAll(t *testing.T, r *ReliableUDP, datagrams [][]byte) [][]byte {
+	t.Helper()
+	var messages [][]byte
+	for _, datagram := range datagrams {
+		received, err := r.Receive(datagram)
+		if err != nil {
+			t.Fatalf("Receive: %v", err)
+		}
+		messages = append(messages, received...)
+	}
+	return messages
+}
+
+func TestReliableUDPDeliversInOrder(t *testing.T) {
+	sender, sent, receiver, _ := reliablePair(t)
+	large := bytes.Repeat([]byte("x"), 3*reliableFragmentSize+10)
+	sender.Send([]byte("first"))
+	sender.Send(large)
+	sender.Send([]byte("third"))
+	if len(*sent) != 6 {
+		t.Fatalf("sent %d datagrams, want 6", len(*sent))
+	}
+
+	// Reverse the datagrams: nothing can be delivered before the first one
+	reversed := make([][]byte, len(*sent))
+	for i, datagram := range *sent {
+		reversed[len(reversed)-1-i] = datagram
+	}
+	messages := receiveAll(t, receiver, reversed)
+	want := [][]byte{[]byte("first"), large, []byte("third")}
+	if len(messages) != len(want) {
+		t.Fatalf("delivered %d messages, want %d", len(messages), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(messages[i], want[i]) {
+			t.Errorf("message %d = %.20q, want %.20q", i, messages[i], want[i])
+		}
+	}
+}
+
+func TestReliableUDPDropsDuplicates(t *testing.T) {
+	sender, sent, receiver, acks := reliablePair(t)
+	sender.Send([]byte("once"))
+	messages := receiveAll(t, receiver, [][]byte{(*sent)[0], (*sent)[0]})
+	if len(messages) != 1 {
+		t.Fatalf("delivered %d messages, want 1", len(messages))
+	}
+	// The duplicate is acknowledged again in case the first ack was lost
+	if len(*acks) != 2 {
+		t.Errorf("sent %d acknowledgements, want 2", len(*acks))
+	}
+
+	receiveAll(t, sender, *acks)
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	if len(sender.unacked) != 0 {
+		t.Errorf("%d fragments left unacknowledged", len(sender.unacked))
+	}
+}
+
+func TestReliableUDPSkipsGaps(t *testing.T) {
+	sender, sent, receiver, _ := reliablePair(t)
+	sender.Send([]byte("lost"))
+	sender.Send([]byte("second"))
+	sender.Send([]byte("third"))
+
+	if messages := receiveAll(t, receiver, (*sent)[1:2]); len(messages) != 0 {
+		t.Fatalf("delivered %q past a gap", messages)
+	}
+	receiver.mutex.Lock()
+	receiver.gapSince = time.Now().Add(-reassemblyTimeout - time.Second)
+	receiver.mutex.Unlock()
+
+	messages := receiveAll(t, receiver, (*sent)[2:3])
+	if len(messages) != 2 || string(messages[0]) != "second" || string(messages[1]) != "third" {
+		t.Fatalf("delivered %q, want [second third]", messages)
+	}
+}
+
+func TestReliableUDPResetsOnNewEpoch(t *testing.T) {
+	sender, sent, receiver, _ := reliablePair(t)
+	sender.Send([]byte("before"))
+	sender.Send([]byte("restart"))
+	receiveAll(t, receiver, (*sent)[:1])
+
+	// A restarted peer numbers its messages from 1 again
+	restarted, resent, _, _ := reliablePair(t)
+	restarted.Send([]byte("after"))
+	messages := receiveAll(t, receiver, *resent)
+	if len(messages) != 1 || string(messages[0]) != "after" {
+		t.Fatalf("delivered %q, want [after]", messages)
+	}
+}
+
+func TestReliableUDPRejectsOversizedFragments(t *testing.T) {
+	_, _, receiver, acks := reliablePair(t)
+	packet := receiver.header(reliableData, 1, 1, 0, 1)
+	packet = append(packet, make([]byte, reliableFragmentSize+1)...)
+	if _, err := receiver.Receive(packet); err == nil {
+		t.Error("accepted a fragment larger than reliableFragmentSize")
+	}
+
+	short := receiver.header(reliableData, 1, 1, 0, 2)
+	short = append(short, make([]byte, 10)...)
+	if _, err := receiver.Receive(short); err == nil {
+		t.Error("accepted a short fragment before the last one")
+	}
+	if len(*acks) != 0 {
+		t.Errorf("acknowledged %d refused fragments", len(*acks))
+	}
+}
+
+func TestReliableUDPBoundsBufferedBytes(t *testing.T) {
+	_, _, receiver, _ := reliablePair(t)
+	fragment := make([]byte, reliableFragmentSize)
+	var refused bool
+	// Fill messages past the missing first one with fragments that never
+	// complete them
+	for seq := uint32(2); seq < reliableWindow && !refused; seq++ {
+		for index := uint16(0); index < reliableMaxFragments-1; index++ {
+			packet := receiver.header(reliableData, 1, seq, index, reliableMaxFragments)
+			_, err := receiver.Receive(append(packet, fragment...))
+			if err != nil {
+				refused = true
+				break
+			}
+		}
+	}
+	if !refused {
+		t.Fatal("buffered fragments without limit")
+	}
+	receiver.mutex.Lock()
+	buffered := receiver.buffered
+	receiver.mutex.Unlock()
+	if buffered > reliableMaxBuffered {
+		t.Errorf("buffered %d bytes, limit %d", buffered, reliableMaxBuffered)
+	}
+
+	// The next message to deliver still gets through
+	packet := receiver.header(reliableData, 1, 1, 0, 1)
+	messages, err := receiver.Receive(append(packet, "next"...))
+	if err != nil || len(messages) != 1 || string(messages[0]) != "next" {
+		t.Fatalf("Receive = %q, %v, want [next]", messages, err)
+	}
+}
+
+func TestReliableUDPRejectsFarAheadFragments(t *testing.T) {
+	_, _, receiver, acks := reliablePair(t)
+	packet := receiver.header(reliableData, 1, reliableWindow+1, 0, 1)
+	if _, err := receiver.Receive(packet); err == nil {
+		t.Error("accepted a fragment past the window")
+	}
+	if len(*acks) != 0 {
+		t.Error("acknowledged a fragment past the window")
+	}
+}
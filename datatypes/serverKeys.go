@@ -0,0 +1,130 @@
+package datatypes
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"strings"
+)
+
+const endorsementHeader = "Endorsement-"
+
+// ServerKeys is what the server advertises at Login: its current public key
+// first, then the keys it is retiring. While a key is retiring it endorses
+// the current one, so a client that cached it can trust the new key without
+// starting over. The encoding is a PEM bundle whose first block is the
+// current key, which is all clients that predate rotation read.
+type ServerKeys struct {
+	Current  string
+	Retiring []string
+	// Endorsements are signatures of the current key by retiring keys
+	Endorsements map[KeyID][]byte
+}
+
+// Endorse adds a retiring key, which signs the DER encoding of the current
+// key with its private key.
+func (k *ServerKeys) Endorse(privateKey string, publicKey string) error {
+	der, err := publicKeyDER(k.Current)
+	if err != nil {
+		return err
+	}
+	keyID, err := KeyIDOf(publicKey)
+	if err != nil {
+		return err
+	}
+	signature, err := SignMessage(privateKey, der)
+	if err != nil {
+		return err
+	}
+	if k.Endorsements == nil {
+		k.Endorsements = make(map[KeyID][]byte)
+	}
+	k.Endorsements[keyID] = signature
+	k.Retiring = append(k.Retiring, publicKey)
+	return nil
+}
+
+// Trusts tells whether a client that cached publicKey may trust the current
+// key: it is the current key, or one of the retiring keys endorsed it.
+func (k ServerKeys) Trusts(publicKey string) bool {
+	keyID, err := KeyIDOf(publicKey)
+	if err != nil {
+		return false
+	}
+	currentID, err := KeyIDOf(k.Current)
+	if err != nil {
+		return false
+	}
+	if keyID == currentID {
+		return true
+	}
+	signature, ok := k.Endorsements[keyID]
+	if !ok {
+		return false
+	}
+	der, err := publicKeyDER(k.Current)
+	if err != nil {
+		return false
+	}
+	return VerifyMessage(publicKey, der, signature) == nil
+}
+
+func (k ServerKeys) Marshal() string {
+	block, _ := pem.Decode([]byte(k.Current))
+	if block == nil {
+		return k.Current
+	}
+	headers := make(map[string]string)
+	for keyID, signature := range k.Endorsements {
+		headers[endorsementHeader+keyID.String()] = base64.StdEncoding.EncodeToString(signature)
+	}
+	bundle := string(pem.EncodeToMemory(&pem.Block{Type: block.Type, Headers: headers, Bytes: block.Bytes}))
+	return bundle + strings.Join(k.Retiring, "")
+}
+
+func ParseServerKeys(bundle string) (ServerKeys, error) {
+	var keys ServerKeys
+	rest := []byte(bundle)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		publicKey := string(pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: block.Bytes}))
+		if keys.Current != "" {
+			keys.Retiring = append(keys.Retiring, publicKey)
+			continue
+		}
+		keys.Current = publicKey
+		for name, value := range block.Headers {
+			if !strings.HasPrefix(name, endorsementHeader) {
+				continue
+			}
+			keyID, err := ParseKeyID(strings.TrimPrefix(name, endorsementHeader))
+			if err != nil {
+				return ServerKeys{}, err
+			}
+			signature, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return ServerKeys{}, err
+			}
+			if keys.Endorsements == nil {
+				keys.Endorsements = make(map[KeyID][]byte)
+			}
+			keys.Endorsements[keyID] = signature
+		}
+	}
+	if keys.Current == "" {
+		return ServerKeys{}, errors.New("no server key")
+	}
+	return keys, nil
+}
+
+func publicKeyDER(publicKey string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return nil, errors.New("Failed to decode public key")
+	}
+	return block.Bytes, nil
+}
@@ -0,0 +1,152 @@
+package datatypes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"sync"
+)
+
+// EphemeralKeySize is the size of an X25519 public key
+const EphemeralKeySize = 32
+
+const counterSize = 8
+
+// replayWindow is how far behind the highest counter seen a message may
+// arrive, to tolerate concurrent readers on the client
+const replayWindow = 64
+
+// SessionCipher protects TLVs with the symmetric key agreed during the
+// handshake that follows Login. Each direction has its own key, so the nonce
+// is simply the message counter, which is sent in clear in front of the
+// ciphertext. The tag and the ID are authenticated as additional data.
+type SessionCipher struct {
+	mutex       sync.Mutex
+	sendAEAD    cipher.AEAD
+	receiveAEAD cipher.AEAD
+	sendCounter uint64
+	highest     uint64
+	seen        uint64
+}
+
+func GenerateEphemeralKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// NewSessionCipher derives the session keys from the X25519 exchange. The
+// transcript is the client ephemeral public key followed by the server's.
+func NewSessionCipher(private *ecdh.PrivateKey, peerPublic []byte, isServer bool) (*SessionCipher, error) {
+	peerKey, err := ecdh.X25519().NewPublicKey(peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := private.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientPublic, serverPublic := private.PublicKey().Bytes(), peerPublic
+	if isServer {
+		clientPublic, serverPublic = peerPublic, private.PublicKey().Bytes()
+	}
+	transcript := append(append([]byte{}, clientPublic...), serverPublic...)
+
+	// HKDF-SHA256 with the transcript as salt
+	prk := hkdf.Extract(sha256.New, shared, transcript)
+	clientToServer, err := newSessionAEAD(prk, "client to server")
+	if err != nil {
+		return nil, err
+	}
+	serverToClient, err := newSessionAEAD(prk, "server to client")
+	if err != nil {
+		return nil, err
+	}
+
+	if isServer {
+		return &SessionCipher{sendAEAD: serverToClient, receiveAEAD: clientToServer}, nil
+	}
+	return &SessionCipher{sendAEAD: clientToServer, receiveAEAD: serverToClient}, nil
+}
+
+func newSessionAEAD(prk []byte, info string) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte(info)), key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// IsSessionTag reports whether a TLV with this tag is sealed once a session
+// key exists. Transport negotiation and the handshake itself are not.
+func IsSessionTag(tag uint8) bool {
+	return tag != 0x01 && tag != 0x02 && tag != 0x04 && tag != HelloTag
+}
+
+func (c *SessionCipher) Seal(t *TLV) {
+	c.mutex.Lock()
+	c.sendCounter++
+	counter := c.sendCounter
+	c.mutex.Unlock()
+
+	sealed := make([]byte, counterSize, counterSize+len(t.Value)+c.sendAEAD.Overhead())
+	binary.BigEndian.PutUint64(sealed, counter)
+	sealed = c.sendAEAD.Seal(sealed, sessionNonce(counter), t.Value, additionalData(t))
+	t.Value = sealed
+	t.Length = len(t.Value)
+}
+
+func (c *SessionCipher) Open(t *TLV) error {
+	if len(t.Value) < counterSize {
+		return errors.New("sealed value too short")
+	}
+	counter := binary.BigEndian.Uint64(t.Value[:counterSize])
+	value, err := c.receiveAEAD.Open(nil, sessionNonce(counter), t.Value[counterSize:], additionalData(t))
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch {
+	case counter > c.highest:
+		shift := counter - c.highest
+		if shift >= replayWindow {
+			c.seen = 0
+		} else {
+			c.seen <<= shift
+		}
+		c.seen |= 1
+		c.highest = counter
+	case c.highest-counter >= replayWindow:
+		return errors.New("sealed message too old")
+	case c.seen&(1<<(c.highest-counter)) != 0:
+		return errors.New("sealed message replayed")
+	default:
+		c.seen |= 1 << (c.highest - counter)
+	}
+
+	t.Value = value
+	t.Length = len(value)
+	return nil
+}
+
+func additionalData(t *TLV) []byte {
+	return binary.BigEndian.AppendUint32([]byte{t.Tag}, t.ID)
+}
+
+func sessionNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
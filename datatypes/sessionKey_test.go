@@ -0,0 +1,96 @@
+package datatypes
+
+import (
+	"bytes"
+	"testing"
+)
+
+// sessionPair returns the ciphers both ends derive from one key exchange.
+func sessionPair(t *testing.T) (client *SessionCipher, server *SessionCipher) {
+	clientKey, err := GenerateEphemeralKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := GenerateEphemeralKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = NewSessionCipher(clientKey, serverKey.PublicKey().Bytes(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewSessionCipher(serverKey, clientKey.PublicKey().Bytes(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// sealed returns n messages sealed by c, in sending order.
+func sealed(c *SessionCipher, n int) []TLV {
+	messages := make([]TLV, n)
+	for i := range messages {
+		messages[i] = NewTLV(0x80, []byte{byte(i)})
+		c.Seal(&messages[i])
+	}
+	return messages
+}
+
+func TestSessionCipherOpensSealed(t *testing.T) {
+	client, server := sessionPair(t)
+	tlv := NewTLV(0x80, []byte("move e2e4"))
+	tlv.ID = 7
+	client.Seal(&tlv)
+	if bytes.Contains(tlv.Value, []byte("e2e4")) {
+		t.Fatal("sealed value holds the plaintext")
+	}
+	if err := server.Open(&tlv); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if string(tlv.Value) != "move e2e4" {
+		t.Errorf("opened %q", tlv.Value)
+	}
+
+	// The ID is authenticated
+	tlv = NewTLV(0x80, []byte("move e2e4"))
+	client.Seal(&tlv)
+	tlv.ID = 8
+	if err := server.Open(&tlv); err == nil {
+		t.Error("opened a message whose ID changed")
+	}
+}
+
+func TestSessionCipherReplayWindow(t *testing.T) {
+	client, server := sessionPair(t)
+	messages := sealed(client, replayWindow+2)
+	open := func(i int) error {
+		tlv := messages[i]
+		return server.Open(&tlv)
+	}
+
+	// Out of order within the window is fine, once
+	for _, i := range []int{3, 2, 5, 4} {
+		if err := open(i); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	for _, i := range []int{2, 5} {
+		if err := open(i); err == nil {
+			t.Errorf("message %d opened twice", i)
+		}
+	}
+
+	// Moving the window past a message never opened makes it too old
+	if err := open(replayWindow + 1); err != nil {
+		t.Fatalf("message %d: %v", replayWindow+1, err)
+	}
+	if err := open(2); err == nil {
+		t.Error("message 2 opened twice")
+	}
+	if err := open(6); err != nil {
+		t.Errorf("message 6, inside the window: %v", err)
+	}
+	if err := open(1); err == nil {
+		t.Error("message 1 opened once behind the window")
+	}
+}
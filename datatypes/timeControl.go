@@ -0,0 +1,109 @@
+package datatypes
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeControl is how much time players get for a game. In a live game each
+// player starts with Base and either gets Increment more after each of their
+// moves, or Delay free at the start of each of their moves before their clock
+// runs. A correspondence game gives DaysPerMove days for every move instead.
+// The zero value is an untimed game.
+type TimeControl struct {
+	Base        time.Duration
+	Increment   time.Duration
+	Delay       time.Duration
+	DaysPerMove int
+}
+
+var errInvalidTimeControl = errors.New("invalid time control")
+
+// maxDaysPerMove is the most days per move whose InitialTime fits in a
+// time.Duration.
+const maxDaysPerMove = math.MaxInt64 / int64(24*time.Hour)
+
+// Timed tells whether the game has clocks.
+func (tc TimeControl) Timed() bool {
+	return tc != TimeControl{}
+}
+
+// InitialTime is the time on both clocks when the game starts.
+func (tc TimeControl) InitialTime() time.Duration {
+	if tc.DaysPerMove > 0 {
+		return time.Duration(tc.DaysPerMove) * 24 * time.Hour
+	}
+	return tc.Base
+}
+
+// String formats the time control the usual way: base minutes + increment
+// seconds like "5+3", base minutes d delay seconds like "5d2", or "3 days"
+// per move. Untimed games are "-".
+func (tc TimeControl) String() string {
+	switch {
+	case !tc.Timed():
+		return "-"
+	case tc.DaysPerMove == 1:
+		return "1 day"
+	case tc.DaysPerMove > 0:
+		return strconv.Itoa(tc.DaysPerMove) + " days"
+	case tc.Delay > 0:
+		return formatMinutes(tc.Base) + "d" + strconv.Itoa(int(tc.Delay/time.Second))
+	default:
+		return formatMinutes(tc.Base) + "+" + strconv.Itoa(int(tc.Increment/time.Second))
+	}
+}
+
+// ParseTimeControl reverses String.
+func ParseTimeControl(s string) (TimeControl, error) {
+	if s == "-" || s == "" {
+		return TimeControl{}, nil
+	}
+	if days, found := strings.CutSuffix(s, " days"); found || strings.HasSuffix(s, " day") {
+		days = strings.TrimSuffix(days, " day")
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 || int64(n) > maxDaysPerMove {
+			return TimeControl{}, errInvalidTimeControl
+		}
+		return TimeControl{DaysPerMove: n}, nil
+	}
+
+	separator := "+"
+	if !strings.Contains(s, "+") {
+		separator = "d"
+	}
+	base, extra, found := strings.Cut(s, separator)
+	if !found {
+		return TimeControl{}, errInvalidTimeControl
+	}
+	// Written this way round so NaN is refused too, and the durations must
+	// fit in a time.Duration
+	minutes, err := strconv.ParseFloat(base, 64)
+	if err != nil || !(minutes > 0 && minutes*float64(time.Minute) < math.MaxInt64) {
+		return TimeControl{}, errInvalidTimeControl
+	}
+	seconds, err := strconv.Atoi(extra)
+	if err != nil || seconds < 0 || int64(seconds) > math.MaxInt64/int64(time.Second) {
+		return TimeControl{}, errInvalidTimeControl
+	}
+	tc := TimeControl{Base: time.Duration(minutes * float64(time.Minute))}
+	if tc.Base <= 0 {
+		// Less than a nanosecond
+		return TimeControl{}, errInvalidTimeControl
+	}
+	if separator == "+" {
+		tc.Increment = time.Duration(seconds) * time.Second
+	} else {
+		tc.Delay = time.Duration(seconds) * time.Second
+	}
+	return tc, nil
+}
+
+// formatMinutes writes d in minutes, with decimals only when needed as in
+// "0.5+0".
+func formatMinutes(d time.Duration) string {
+	return strconv.FormatFloat(d.Minutes(), 'f', -1, 64)
+}
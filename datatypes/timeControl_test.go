@@ -0,0 +1,47 @@
+package datatypes
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeControlRoundTrip(t *testing.T) {
+	for _, tc := range []TimeControl{
+		{},
+		{Base: 5 * time.Minute, Increment: 3 * time.Second},
+		{Base: 30 * time.Second},
+		{Base: 90 * time.Second, Delay: 2 * time.Second},
+		{DaysPerMove: 1},
+		{DaysPerMove: 3},
+	} {
+		parsed, err := ParseTimeControl(tc.String())
+		if err != nil {
+			t.Errorf("ParseTimeControl(%q): %v", tc.String(), err)
+			continue
+		}
+		if parsed != tc {
+			t.Errorf("ParseTimeControl(%q) = %+v, want %+v", tc.String(), parsed, tc)
+		}
+	}
+}
+
+func TestParseTimeControlRejectsInvalid(t *testing.T) {
+	for _, s := range []string{
+		"5",
+		"0+3",
+		"-5+3",
+		"5+-3",
+		"NaN+0",
+		"Inf+0",
+		"1e-20+0",
+		"0 days",
+		// Past what a time.Duration holds
+		"1e300+0",
+		"5+9223372037",
+		"106752 days",
+	} {
+		if tc, err := ParseTimeControl(s); err == nil {
+			t.Errorf("ParseTimeControl(%q) = %+v, want an error", s, tc)
+		}
+	}
+}
@@ -8,15 +8,19 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"io"
-	"log"
 	"strings"
+	"time"
 )
 
 type TLV struct {
-	Tag    uint8
+	Tag uint8
+	// ID matches a response to its request. Only FramingMultiplexed carries
+	// it, responses echo the ID of the request and pushed events use 0.
+	ID     uint32
 	Length int
 	Value  []byte
 }
@@ -67,42 +71,190 @@ func Decode(b []byte) (TLV, error) {
 	}, nil
 }
 
-func (t *TLV) Sign(privateKey string) {
+const (
+	signatureSize = 256
+	nonceSize     = 16
+	// ';', key ID, timestamp, nonce and signature appended to a signed value
+	signatureTrailerSize = 1 + len(KeyID{}) + 8 + nonceSize + signatureSize
+	// offsets inside the trailer
+	keyIDOffset     = 1
+	timestampOffset = keyIDOffset + len(KeyID{})
+	nonceOffset     = timestampOffset + 8
+	signatureOffset = nonceOffset + nonceSize
+)
+
+// Sign appends the signer's key ID, a timestamp, a random nonce and an RSA
+// signature to the value. The signature covers the tag, the value and all of
+// these, so a signed TLV cannot be replayed under another tag, receivers can
+// reject stale or already seen requests, and they know which key to verify
+// it with without trying them all.
+func (t *TLV) Sign(privateKey string) error {
 	block, _ := pem.Decode([]byte(privateKey))
 	if block == nil {
-		log.Fatal("Failed to decode private key")
+		return errors.New("Failed to decode private key")
 	}
 	parsedKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	hashed := sha256.Sum256(t.Value)
-	signature, err := rsa.SignPKCS1v15(rand.Reader, parsedKey, crypto.SHA256, hashed[:])
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&parsedKey.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	keyID := keyIDOfDER(publicKeyBytes)
+	signed := make([]byte, signatureOffset-keyIDOffset)
+	copy(signed, keyID[:])
+	binary.BigEndian.PutUint64(signed[timestampOffset-keyIDOffset:], uint64(time.Now().Unix()))
+	if _, err := rand.Read(signed[nonceOffset-keyIDOffset:]); err != nil {
+		return err
+	}
+
+	hashed := t.signedHash(t.Value, signed)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, parsedKey, crypto.SHA256, hashed)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	t.Value = append(t.Value, ";"...)
+	t.Value = append(t.Value, signed...)
 	t.Value = append(t.Value, signature...)
 	t.Length = len(t.Value)
+	return nil
 }
 
 func (t *TLV) Verify(publicKey string) (bool, error) {
-	block, _ := pem.Decode([]byte(publicKey))
+	trailer := t.trailer()
+	if trailer == nil {
+		return false, errors.New("value too short to hold a signature")
+	}
+	rsaKey, err := parseRSAPublicKey(publicKey)
+	if err != nil {
+		return false, err
+	}
+	hashed := t.signedHash(t.Payload(), trailer[keyIDOffset:signatureOffset])
+	err = rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hashed, trailer[signatureOffset:])
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (t *TLV) signedHash(payload []byte, signed []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{t.Tag})
+	h.Write(payload)
+	h.Write(signed)
+	return h.Sum(nil)
+}
+
+func (t *TLV) trailer() []byte {
+	if len(t.Value) < signatureTrailerSize {
+		return nil
+	}
+	return t.Value[len(t.Value)-signatureTrailerSize:]
+}
+
+// Payload returns the value without the signature trailer.
+func (t *TLV) Payload() []byte {
+	if t.trailer() == nil {
+		return t.Value
+	}
+	return t.Value[:len(t.Value)-signatureTrailerSize]
+}
+
+// KeyID returns the ID of the key the TLV claims to be signed with. It is
+// only trustworthy once Verify succeeded with that key.
+func (t *TLV) KeyID() KeyID {
+	var id KeyID
+	if trailer := t.trailer(); trailer != nil {
+		copy(id[:], trailer[keyIDOffset:timestampOffset])
+	}
+	return id
+}
+
+// SignedAt returns the time at which the TLV was signed.
+func (t *TLV) SignedAt() time.Time {
+	trailer := t.trailer()
+	if trailer == nil {
+		return time.Time{}
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(trailer[timestampOffset:nonceOffset])), 0)
+}
+
+// Nonce returns the random nonce included in the signature.
+func (t *TLV) Nonce() [nonceSize]byte {
+	var nonce [nonceSize]byte
+	if trailer := t.trailer(); trailer != nil {
+		copy(nonce[:], trailer[nonceOffset:signatureOffset])
+	}
+	return nonce
+}
+
+// StripSignature drops the signature trailer once it has been verified.
+func (t *TLV) StripSignature() {
+	t.Value = t.Payload()
+	t.Length = len(t.Value)
+}
+
+// legacySignatureTrailerSize is the ';' and the signature SignLegacy appends.
+const legacySignatureTrailerSize = 1 + signatureSize
+
+// SignLegacy signs the value the way peers did before the hello: ';' and an
+// RSA signature of the value alone. It covers neither the tag nor when the
+// TLV was sent, so it can be replayed, and only sessions with such peers use
+// it.
+func (t *TLV) SignLegacy(privateKey string) error {
+	block, _ := pem.Decode([]byte(privateKey))
 	if block == nil {
-		return false, errors.New("Failed to decode public key")
+		return errors.New("Failed to decode private key")
 	}
-	parsedKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	parsedKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256(t.Value)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, parsedKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+	t.Value = append(t.Value, ";"...)
+	t.Value = append(t.Value, signature...)
+	t.Length = len(t.Value)
+	return nil
+}
+
+// VerifyLegacy checks a signature made by SignLegacy.
+func (t *TLV) VerifyLegacy(publicKey string) (bool, error) {
+	if len(t.Value) < legacySignatureTrailerSize {
+		return false, errors.New("value too short to hold a signature")
+	}
+	rsaKey, err := parseRSAPublicKey(publicKey)
 	if err != nil {
 		return false, err
 	}
-	hashed := sha256.Sum256(t.Value[:len(t.Value)-256-1])
-	err = rsa.VerifyPKCS1v15(parsedKey.(*rsa.PublicKey), crypto.SHA256, hashed[:], t.Value[len(t.Value)-256:])
+	hashed := sha256.Sum256(t.LegacyPayload())
+	err = rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hashed[:], t.Value[len(t.Value)-signatureSize:])
 	if err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
+// LegacyPayload returns the value without the signature of SignLegacy.
+func (t *TLV) LegacyPayload() []byte {
+	if len(t.Value) < legacySignatureTrailerSize {
+		return t.Value
+	}
+	return t.Value[:len(t.Value)-legacySignatureTrailerSize]
+}
+
+// StripLegacySignature drops the signature of SignLegacy once it has been
+// verified.
+func (t *TLV) StripLegacySignature() {
+	t.Value = t.LegacyPayload()
+	t.Length = len(t.Value)
+}
+
 func (t *TLV) Encrypt(publicKey string) error {
 	// Decode the public key
 	block, _ := pem.Decode([]byte(publicKey))
@@ -183,9 +335,6 @@ func (t *TLV) Decrypt(privateKey string) error {
 	// Decrypt the AES key
 	aesKey, err := rsa.DecryptPKCS1v15(rand.Reader, parsedKey, t.Value[:encryptedKeySize])
 	if err != nil {
-		// TODO: fix here
-		log.Println(t.Tag)
-		log.Println(string(t.Value))
 		return err
 	}
 
@@ -1,9 +1,27 @@
 package datatypes
 
 import (
+	"errors"
 	"strconv"
+	"strings"
 )
 
+// RegistrationVersion is the first protocol version where players register
+// with Register and Login only proves possession of the key. Before it,
+// Login carries a User and registers unknown keys on the fly.
+const RegistrationVersion uint16 = 4
+
+// Tags of the profile commands, from RegistrationVersion on. Register is
+// signed with the key being registered and sent before Login.
+const (
+	RegisterTag      uint8 = 0x06
+	GetProfileTag    uint8 = 0x23
+	UpdateProfileTag uint8 = 0x24
+)
+
+// User is a player profile. Clients send one to register, where only the
+// names and the public key are read: the rating and IsActive are the
+// server's to decide. The server answers the profile commands with one.
 type User struct {
 	FirstName string
 	LastName  string
@@ -22,12 +40,113 @@ func NewUser(firstName string, lastName string, isActive bool, elo int, publicKe
 	}
 }
 
-func (u *User) CreateTLV() TLV {
-	isActive := 0
-	if u.IsActive {
-		isActive = 1
+const (
+	userFirstName uint8 = iota + 1
+	userLastName
+	userIsActive
+	userElo
+	userPublicKey
+)
+
+// CreateTLV builds the Login TLV of versions before RegistrationVersion, in
+// the payload format of version.
+func (u *User) CreateTLV(version uint16) TLV {
+	return NewTLV(0x00, u.Marshal(version))
+}
+
+func (u *User) Marshal(version uint16) []byte {
+	if version < TypedPayloadVersion {
+		isActive := 0
+		if u.IsActive {
+			isActive = 1
+		}
+		return []byte(u.FirstName + ";" + u.LastName + ";" + strconv.Itoa(isActive) + ";" + strconv.Itoa(u.Elo) + ";" + u.PublicKey)
+	}
+	var f fields
+	f.addString(userFirstName, u.FirstName)
+	f.addString(userLastName, u.LastName)
+	f.addBool(userIsActive, u.IsActive)
+	f.addInt(userElo, int64(u.Elo))
+	f.addString(userPublicKey, u.PublicKey)
+	return f.b
+}
+
+func (u *User) Unmarshal(b []byte, version uint16) error {
+	if version < TypedPayloadVersion {
+		val := strings.Split(string(b), ";")
+		if len(val) < 5 {
+			return errors.New("malformed login")
+		}
+		u.FirstName = val[0]
+		u.LastName = val[1]
+		u.IsActive = val[2] == "1"
+		u.Elo, _ = strconv.Atoi(val[3])
+		u.PublicKey = val[4]
+		return nil
 	}
-	v := []byte(u.FirstName + ";" + u.LastName + ";" + strconv.Itoa(isActive) + ";" + strconv.Itoa(u.Elo) + ";" + u.PublicKey)
-	tlv := NewTLV(0x00, v)
-	return tlv
+	return parseFields(b, func(field uint8, value []byte) error {
+		var err error
+		switch field {
+		case userFirstName:
+			u.FirstName = string(value)
+		case userLastName:
+			u.LastName = string(value)
+		case userIsActive:
+			u.IsActive, err = fieldBool(value)
+		case userElo:
+			var elo int64
+			elo, err = fieldInt(value)
+			u.Elo = int(elo)
+		case userPublicKey:
+			u.PublicKey = string(value)
+		}
+		return err
+	})
+}
+
+// ProfileUpdate changes the profile of the player sending it. Empty names and
+// a nil IsActive are left as they are. It only exists from
+// RegistrationVersion on, so it is always typed.
+type ProfileUpdate struct {
+	FirstName string
+	LastName  string
+	IsActive  *bool
+}
+
+const (
+	profileUpdateFirstName uint8 = iota + 1
+	profileUpdateLastName
+	profileUpdateIsActive
+)
+
+func (m ProfileUpdate) Marshal() []byte {
+	var f fields
+	if m.FirstName != "" {
+		f.addString(profileUpdateFirstName, m.FirstName)
+	}
+	if m.LastName != "" {
+		f.addString(profileUpdateLastName, m.LastName)
+	}
+	if m.IsActive != nil {
+		f.addBool(profileUpdateIsActive, *m.IsActive)
+	}
+	return f.b
+}
+
+func (m *ProfileUpdate) Unmarshal(b []byte) error {
+	return parseFields(b, func(field uint8, value []byte) error {
+		switch field {
+		case profileUpdateFirstName:
+			m.FirstName = string(value)
+		case profileUpdateLastName:
+			m.LastName = string(value)
+		case profileUpdateIsActive:
+			isActive, err := fieldBool(value)
+			if err != nil {
+				return err
+			}
+			m.IsActive = &isActive
+		}
+		return nil
+	})
 }
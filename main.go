@@ -1,17 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
+	"os"
+	"os/signal"
 	"reseau2TP2/client"
 	"reseau2TP2/datatypes"
 	_ "reseau2TP2/datatypes"
 	"reseau2TP2/server"
+	"syscall"
 	"time"
 )
 
 func main() {
-	err := server.Init()
+	config, err := server.ParseConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := server.NewServer(config)
+	err = srv.Start()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -22,22 +32,19 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	user := datatypes.NewUser("John", "Doe", true, 1500, c1.KeyPair.PublicKey)
-	err = c1.Login(*user)
+	err = login(&c1, "John", "Doe")
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	c2, err := client.Init("./client/config2.json", 2)
-	user2 := datatypes.NewUser("Jane", "Doe", true, 1500, c2.KeyPair.PublicKey)
-	err = c2.Login(*user2)
+	err = login(&c2, "Jane", "Doe")
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	c3, err := client.Init("./client/config3.json", 3)
-	user3 := datatypes.NewUser("Jack", "Doe", true, 1500, c3.KeyPair.PublicKey)
-	err = c3.Login(*user3)
+	err = login(&c3, "Jack", "Doe")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -46,7 +53,7 @@ func main() {
 	//c1.CLI()
 
 	//Demo 2
-	// c2.HostGame()
+	// c2.HostGame(datatypes.TimeControl{})
 	// games := c2.GetAvailableGames()
 	// c3.JoinGame(games[0])
 	// c2.PlayMove("e4")
@@ -78,5 +85,23 @@ func main() {
 	time.Sleep(100 * time.Millisecond)
 	c2.PlayMove("O-O")
 
-	select {}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// login logs c in, registering it the first time.
+func login(c *client.Client, firstName string, lastName string) error {
+	_, err := c.Register(firstName, lastName)
+	if err != nil && !errors.Is(err, datatypes.ErrAlreadyRegistered) {
+		return err
+	}
+	return c.Login()
 }
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"reseau2TP2/datatypes"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/notnil/chess"
+)
+
+// apiBodyLimit bounds the body of a request to the HTTP API.
+const apiBodyLimit = 1 << 16
+
+type apiUser struct {
+	ID        int    `json:"id"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Active    bool   `json:"active"`
+	Elo       int    `json:"elo"`
+	PublicKey string `json:"publicKey"`
+	KeyID     string `json:"keyID"`
+}
+
+type apiGame struct {
+	ID           string `json:"id"`
+	WhiteID      int    `json:"whiteID"`
+	BlackID      int    `json:"blackID"`
+	FEN          string `json:"fen"`
+	Outcome      string `json:"outcome"`
+	Method       string `json:"method"`
+	LastMoveTime string `json:"lastMoveTime"`
+	TimeControl  string `json:"timeControl"`
+	// WhiteTime and BlackTime are the clocks of timed games in
+	// milliseconds, as they were when the current turn started
+	WhiteTime int64 `json:"whiteTime,omitempty"`
+	BlackTime int64 `json:"blackTime,omitempty"`
+}
+
+type apiMove struct {
+	Move string `json:"move"`
+}
+
+// apiError is the body of every failed request. Code is the one the TLV
+// protocol would answer with.
+type apiError struct {
+	Code  datatypes.ErrorCode `json:"code"`
+	Error string              `json:"error"`
+}
+
+// apiRouter serves a REST API over the same database as the TLV protocol,
+// for scripts and dashboards. Reads are public, moves are signed with the
+// player's key in the headers described in datatypes.SignRequestHeaders.
+func (srv *Server) apiRouter() *mux.Router {
+	router := mux.NewRouter()
+	api := router.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/users", srv.handleAPIUsers).Methods(http.MethodGet)
+	api.HandleFunc("/users/{id:[0-9]+}", srv.handleAPIUser).Methods(http.MethodGet)
+	api.HandleFunc("/events", srv.handleAPIEvents).Methods(http.MethodGet)
+	api.HandleFunc("/games", srv.handleAPIGames).Methods(http.MethodGet)
+	api.HandleFunc("/games/available", srv.handleAPIAvailableGames).Methods(http.MethodGet)
+	api.HandleFunc("/games/{id}", srv.handleAPIGame).Methods(http.MethodGet)
+	api.HandleFunc("/games/{id}/pgn", srv.handleAPIPGN).Methods(http.MethodGet)
+	api.HandleFunc("/games/{id}/events", srv.handleAPIGameEvents).Methods(http.MethodGet)
+	api.HandleFunc("/games/{id}/moves", srv.handleAPIPlayMove).Methods(http.MethodPost)
+	return router
+}
+
+func (srv *Server) handleAPIUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := srv.db.getUsers()
+	if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusInternalServerError, datatypes.CodeInternal, "Could not load users")
+		return
+	}
+	response := []apiUser{}
+	for _, user := range users {
+		response = append(response, newAPIUser(user))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (srv *Server) handleAPIUser(w http.ResponseWriter, r *http.Request) {
+	playerID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	user, err := srv.db.getUser(playerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, datatypes.CodeUnknownUser, "Unknown user")
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusInternalServerError, datatypes.CodeInternal, "Could not load user")
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIUser(user))
+}
+
+func (srv *Server) handleAPIGames(w http.ResponseWriter, r *http.Request) {
+	games, err := srv.db.getGames()
+	if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusInternalServerError, datatypes.CodeInternal, "Could not load games")
+		return
+	}
+	writeJSON(w, http.StatusOK, append([]string{}, games...))
+}
+
+func (srv *Server) handleAPIAvailableGames(w http.ResponseWriter, r *http.Request) {
+	games, err := srv.db.getUnstartedGames()
+	if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusInternalServerError, datatypes.CodeInternal, "Could not load games")
+		return
+	}
+	writeJSON(w, http.StatusOK, append([]string{}, games...))
+}
+
+func (srv *Server) handleAPIGame(w http.ResponseWriter, r *http.Request) {
+	record, game, ok := srv.apiLoadGame(w, r)
+	if !ok {
+		return
+	}
+	srv.clocksMutex.Lock()
+	response := newAPIGame(record, game)
+	srv.clocksMutex.Unlock()
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (srv *Server) handleAPIPGN(w http.ResponseWriter, r *http.Request) {
+	_, game, ok := srv.apiLoadGame(w, r)
+	if !ok {
+		return
+	}
+	srv.clocksMutex.Lock()
+	pgn := game.String()
+	srv.clocksMutex.Unlock()
+	w.Header().Set("Content-Type", "application/x-chess-pgn")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, pgn)
+}
+
+// handleAPIPlayMove plays a move like srv.handlePlayMove, for the player who
+// signed the request.
+func (srv *Server) handleAPIPlayMove(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, apiBodyLimit))
+	if err != nil {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, datatypes.CodeMalformedRequest, "Request too large")
+		return
+	}
+	playerID, ok := srv.authenticateAPI(w, r, body)
+	if !ok {
+		return
+	}
+	record, game, ok := srv.apiLoadGame(w, r)
+	if !ok {
+		return
+	}
+	if playerID != record.WhiteID && playerID != record.BlackID {
+		writeAPIError(w, http.StatusForbidden, datatypes.CodeNotInGame, "Player not in game")
+		return
+	}
+
+	var request apiMove
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, datatypes.CodeMalformedRequest, "Malformed move")
+		return
+	}
+	pbKey, _ := srv.db.getPlayerPublicKey(playerID)
+	s, _ := srv.getConnectionForPlayer(pbKey)
+	record, err = srv.submitMove(s, record.ID, game, playerID, request.Move, nil)
+	if errors.Is(err, errAIFailed) {
+		// The move was played, the board without the answer of the AI is
+		// still the right response
+		log.Println(err)
+	} else if err != nil {
+		code, message := moveError(err)
+		writeAPIError(w, apiMoveStatus(err), code, message)
+		return
+	}
+	srv.clocksMutex.Lock()
+	response := newAPIGame(record, game)
+	srv.clocksMutex.Unlock()
+	writeJSON(w, http.StatusOK, response)
+}
+
+// apiMoveStatus is the HTTP status of a move submitMove failed to play.
+func apiMoveStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotYourTurn), errors.Is(err, errGameOver):
+		return http.StatusConflict
+	case errors.Is(err, errInvalidMove):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// authenticateAPI checks the signature headers of a request and returns the
+// ID of the player who signed it. Like authenticate for TLVs, every failure
+// is answered with an error.
+func (srv *Server) authenticateAPI(w http.ResponseWriter, r *http.Request, body []byte) (int, bool) {
+	keyID, err := datatypes.ParseKeyID(r.Header.Get(datatypes.HeaderKeyID))
+	if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, datatypes.CodeInvalidSignature, "Invalid key ID")
+		return -1, false
+	}
+	timestamp := r.Header.Get(datatypes.HeaderTimestamp)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, datatypes.CodeInvalidSignature, "Invalid timestamp")
+		return -1, false
+	}
+	nonceHex := r.Header.Get(datatypes.HeaderNonce)
+	var nonce [16]byte
+	n, err := hex.Decode(nonce[:], []byte(nonceHex))
+	if err != nil || n != len(nonce) {
+		writeAPIError(w, http.StatusUnauthorized, datatypes.CodeInvalidSignature, "Invalid nonce")
+		return -1, false
+	}
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get(datatypes.HeaderSignature))
+	if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, datatypes.CodeInvalidSignature, "Invalid signature")
+		return -1, false
+	}
+
+	key, err := srv.lookupKey(keyID)
+	if err != nil {
+		log.Println("Unknown key", keyID, err)
+		writeAPIError(w, http.StatusUnauthorized, datatypes.CodeInvalidSignature, "Invalid signature")
+		return -1, false
+	}
+	message := datatypes.SignedRequestMessage(r.Method, r.URL.Path, timestamp, nonceHex, body)
+	err = datatypes.VerifyMessage(key.publicKey, message, signature)
+	if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, datatypes.CodeInvalidSignature, "Invalid signature")
+		return -1, false
+	}
+
+	err = srv.checkNonce(key.playerID, time.Unix(unix, 0), nonce)
+	if err != nil {
+		code := datatypes.CodeReplayedRequest
+		if errors.Is(err, errStaleRequest) {
+			code = datatypes.CodeStaleRequest
+		}
+		writeAPIError(w, http.StatusUnauthorized, code, err.Error())
+		return -1, false
+	}
+	return key.playerID, true
+}
+
+// apiLoadGame loads the game named in the path, answering with an error when
+// there is none.
+func (srv *Server) apiLoadGame(w http.ResponseWriter, r *http.Request) (gameRecord, *chess.Game, bool) {
+	gameUUID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, datatypes.CodeUnknownGame, "Unknown game")
+		return gameRecord{}, nil, false
+	}
+	record, err := srv.db.getGame(gameUUID.String())
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, datatypes.CodeUnknownGame, "Unknown game")
+		return gameRecord{}, nil, false
+	}
+	if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusInternalServerError, datatypes.CodeInternal, "Could not load game")
+		return gameRecord{}, nil, false
+	}
+	game, err := srv.cachedGame(gameUUID)
+	if err != nil {
+		log.Println(err)
+		writeAPIError(w, http.StatusInternalServerError, datatypes.CodeInternal, "Could not load game")
+		return gameRecord{}, nil, false
+	}
+	return record, game, true
+}
+
+func newAPIUser(user userRecord) apiUser {
+	return apiUser{
+		ID:        user.ID,
+		FirstName: user.User.FirstName,
+		LastName:  user.User.LastName,
+		Active:    user.User.IsActive,
+		Elo:       user.User.Elo,
+		PublicKey: user.User.PublicKey,
+		KeyID:     user.KeyID,
+	}
+}
+
+func newAPIGame(record gameRecord, game *chess.Game) apiGame {
+	return apiGame{
+		ID:           record.ID,
+		WhiteID:      record.WhiteID,
+		BlackID:      record.BlackID,
+		FEN:          game.FEN(),
+		Outcome:      game.Outcome().String(),
+		Method:       endMethod(game),
+		LastMoveTime: record.LastMoveTime,
+		TimeControl:  record.TimeControl.String(),
+		WhiteTime:    record.WhiteTime.Milliseconds(),
+		BlackTime:    record.BlackTime.Milliseconds(),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code datatypes.ErrorCode, message string) {
+	writeJSON(w, status, apiError{Code: code, Error: message})
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reseau2TP2/datatypes"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/notnil/chess"
+)
+
+// timeForfeit is the standard PGN Termination of games lost on time.
+// notnil/chess has no method for them, so a flag fall is recorded as a
+// resignation or a draw and the tag tells them apart, see endMethod.
+const timeForfeit = "time forfeit"
+
+var (
+	errGameOver    = errors.New("game is over")
+	errInvalidMove = errors.New("invalid move")
+	errNotYourTurn = errors.New("not your turn")
+	// errTimeForfeit is returned for a move played after the flag of the
+	// player fell. The game was lost on time instead.
+	errTimeForfeit = errors.New("flag fell")
+)
+
+// clock is the time left to color when the current turn started.
+func (r gameRecord) clock(color chess.Color) time.Duration {
+	if color == chess.Black {
+		return r.BlackTime
+	}
+	return r.WhiteTime
+}
+
+func (r *gameRecord) setClock(color chess.Color, remaining time.Duration) {
+	if color == chess.Black {
+		r.BlackTime = remaining
+	} else {
+		r.WhiteTime = remaining
+	}
+}
+
+// chargeClock takes the time a player thought, elapsed, from their clock
+// remaining and returns their clock once they moved, or whether their flag
+// fell before.
+func chargeClock(tc datatypes.TimeControl, remaining time.Duration, elapsed time.Duration) (time.Duration, bool) {
+	remaining -= max(elapsed-tc.Delay, 0)
+	if remaining <= 0 {
+		return 0, true
+	}
+	if tc.DaysPerMove > 0 {
+		return tc.InitialTime(), false
+	}
+	return remaining + tc.Increment, false
+}
+
+// playMove plays move for playerID in game and saves it, charging their
+// clock in timed games. It fails with errNotYourTurn unless they are to
+// move. A move of a player out of time is not played: the game is lost on
+// time and errTimeForfeit returned. The record returned has the clocks
+// after the move.
+func (srv *Server) playMove(gameID string, game *chess.Game, playerID int, move string) (gameRecord, error) {
+	srv.clocksMutex.Lock()
+	defer srv.clocksMutex.Unlock()
+
+	record, err := srv.db.getGame(gameID)
+	if err != nil {
+		return gameRecord{}, err
+	}
+	if gameOver(record, game) {
+		return record, errGameOver
+	}
+	now := time.Now()
+	turn := game.Position().Turn()
+	if record.player(turn) != playerID {
+		return record, errNotYourTurn
+	}
+	running := !record.TurnStarted.IsZero()
+	if running {
+		remaining, flagged := chargeClock(record.TimeControl, record.clock(turn), now.Sub(record.TurnStarted))
+		if flagged {
+			record, err = srv.flagFall(record, game)
+			if err != nil {
+				return record, err
+			}
+			return record, errTimeForfeit
+		}
+		record.setClock(turn, remaining)
+	}
+
+	err = game.MoveStr(move)
+	if err != nil {
+		return record, fmt.Errorf("%w: %v", errInvalidMove, err)
+	}
+	err = srv.db.saveGame(gameID, game.String())
+	if err != nil {
+		return record, err
+	}
+	// Moving instead of answering declines a draw offer
+	delete(srv.drawOffers, gameID)
+	if !running {
+		return record, nil
+	}
+	record.TurnStarted = now
+	if game.Outcome() != chess.NoOutcome {
+		record.TurnStarted = time.Time{}
+	}
+	srv.armClock(record, turn.Other())
+	return record, srv.db.saveClocks(record)
+}
+
+// gameOver tells whether game is over. A timed game whose clock stopped is
+// over even when game is a copy evicted from the cache before it ended. The
+// clock of a hosted game only starts once its opponent joins.
+func gameOver(record gameRecord, game *chess.Game) bool {
+	stopped := record.TimeControl.Timed() && record.TurnStarted.IsZero() && record.BlackID != -1
+	return game.Outcome() != chess.NoOutcome || stopped
+}
+
+// flagFall ends game on time for the player to move and stops its clock.
+// They lose, unless their opponent has too little material left to ever
+// mate them.
+func (srv *Server) flagFall(record gameRecord, game *chess.Game) (gameRecord, error) {
+	loser := game.Position().Turn()
+	if insufficientMaterial(game.Position().Board(), loser.Other()) {
+		game.Draw(chess.DrawOffer)
+	} else {
+		game.Resign(loser)
+	}
+	game.AddTagPair("Termination", timeForfeit)
+	log.Println("Flag fell in", record.ID)
+
+	record.setClock(loser, 0)
+	record.TurnStarted = time.Time{}
+	srv.armClock(record, loser)
+	delete(srv.drawOffers, record.ID)
+	err := srv.db.saveGame(record.ID, game.String())
+	if err != nil {
+		return record, err
+	}
+	return record, srv.db.saveClocks(record)
+}
+
+// insufficientMaterial tells whether color has nothing left but its king
+// and at most one knight or bishop.
+func insufficientMaterial(board *chess.Board, color chess.Color) bool {
+	minor := 0
+	for _, piece := range board.SquareMap() {
+		if piece.Color() != color || piece.Type() == chess.King {
+			continue
+		}
+		if piece.Type() != chess.Knight && piece.Type() != chess.Bishop {
+			return false
+		}
+		minor++
+	}
+	return minor <= 1
+}
+
+// endMethod is how game ended. A game loaded from its PGN only knows the
+// methods notnil/chess detects from the moves, so games ended any other way
+// keep it in the Termination tag.
+func endMethod(game *chess.Game) string {
+	tag := game.GetTagPair("Termination")
+	switch {
+	case tag == nil:
+		return game.Method().String()
+	case tag.Value == timeForfeit:
+		return "TimeForfeit"
+	default:
+		return tag.Value
+	}
+}
+
+// armClock sets the timer that flags turn, the player to move in record,
+// when their time runs out, replacing the previous timer of the game. It
+// only stops that timer when the clock of record is stopped. clocksMutex
+// must be held.
+func (srv *Server) armClock(record gameRecord, turn chess.Color) {
+	if timer, ok := srv.clocks[record.ID]; ok {
+		timer.Stop()
+		delete(srv.clocks, record.ID)
+	}
+	if record.TurnStarted.IsZero() {
+		return
+	}
+	deadline := record.TurnStarted.Add(record.clock(turn) + record.TimeControl.Delay)
+	gameID := record.ID
+	srv.clocks[gameID] = time.AfterFunc(time.Until(deadline), func() {
+		srv.checkFlag(gameID)
+	})
+}
+
+// resumeClocks arms the clocks of the games being played, when the server
+// starts. Flags that fell while it was down fall right away.
+func (srv *Server) resumeClocks() error {
+	games, err := srv.db.getRunningClocks()
+	if err != nil {
+		return err
+	}
+	for _, gameID := range games {
+		srv.startClock(gameID)
+	}
+	return nil
+}
+
+// startClock arms the clock of gameID, a timed game just started or resumed.
+func (srv *Server) startClock(gameID string) {
+	srv.clocksMutex.Lock()
+	defer srv.clocksMutex.Unlock()
+	record, game, err := srv.loadClock(gameID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	srv.armClock(record, game.Position().Turn())
+}
+
+// stopClocks stops every timer for Shutdown. Flags do not fall once it
+// returns.
+func (srv *Server) stopClocks() {
+	srv.clocksMutex.Lock()
+	defer srv.clocksMutex.Unlock()
+	for gameID, timer := range srv.clocks {
+		timer.Stop()
+		delete(srv.clocks, gameID)
+	}
+	srv.clocksStopped = true
+}
+
+// checkFlag ends gameID on time when the player to move ran out of it, and
+// pushes the result to both players. It runs when the timer of the game
+// fires, and holds clocksMutex until the flag fell so no move or shutdown
+// gets in between.
+func (srv *Server) checkFlag(gameID string) {
+	record, game, flagged := srv.flagIfOut(gameID)
+	if !flagged {
+		return
+	}
+
+	srv.publishEnd(gameID, game)
+	ratings := srv.rateGame(gameID, game)
+	for _, playerID := range []int{record.WhiteID, record.BlackID} {
+		srv.notifyPlayer(record, game, playerID, ratings)
+	}
+}
+
+// flagIfOut ends gameID on time when the player to move ran out of it, and
+// tells whether they did.
+func (srv *Server) flagIfOut(gameID string) (gameRecord, *chess.Game, bool) {
+	srv.clocksMutex.Lock()
+	defer srv.clocksMutex.Unlock()
+	if srv.clocksStopped {
+		return gameRecord{}, nil, false
+	}
+
+	record, game, err := srv.loadClock(gameID)
+	if err != nil {
+		log.Println(err)
+		return gameRecord{}, nil, false
+	}
+	if record.TurnStarted.IsZero() || game.Outcome() != chess.NoOutcome {
+		return gameRecord{}, nil, false
+	}
+	turn := game.Position().Turn()
+	if _, flagged := chargeClock(record.TimeControl, record.clock(turn), time.Since(record.TurnStarted)); !flagged {
+		srv.armClock(record, turn)
+		return gameRecord{}, nil, false
+	}
+	record, err = srv.flagFall(record, game)
+	if err != nil {
+		log.Println(err)
+		return gameRecord{}, nil, false
+	}
+	return record, game, true
+}
+
+// loadClock loads the record and the game of gameID.
+func (srv *Server) loadClock(gameID string) (gameRecord, *chess.Game, error) {
+	gameUUID, err := uuid.Parse(gameID)
+	if err != nil {
+		return gameRecord{}, nil, err
+	}
+	record, err := srv.db.getGame(gameID)
+	if err != nil {
+		return gameRecord{}, nil, err
+	}
+	game, err := srv.cachedGame(gameUUID)
+	if err != nil {
+		return gameRecord{}, nil, err
+	}
+	return record, game, nil
+}
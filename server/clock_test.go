@@ -0,0 +1,34 @@
+package server
+
+import (
+	"reseau2TP2/datatypes"
+	"testing"
+	"time"
+)
+
+func TestChargeClock(t *testing.T) {
+	blitz := datatypes.TimeControl{Base: 5 * time.Minute, Increment: 3 * time.Second}
+	delay := datatypes.TimeControl{Base: 5 * time.Minute, Delay: 5 * time.Second}
+	daily := datatypes.TimeControl{DaysPerMove: 1}
+	for _, test := range []struct {
+		name      string
+		tc        datatypes.TimeControl
+		remaining time.Duration
+		elapsed   time.Duration
+		want      time.Duration
+		flagged   bool
+	}{
+		{"increment", blitz, time.Minute, 10 * time.Second, 53 * time.Second, false},
+		{"increment after the flag", blitz, time.Minute, time.Minute, 0, true},
+		{"within the delay", delay, time.Minute, 3 * time.Second, time.Minute, false},
+		{"past the delay", delay, time.Minute, 15 * time.Second, 50 * time.Second, false},
+		{"delay does not save a flag", delay, time.Second, 10 * time.Second, 0, true},
+		{"correspondence resets", daily, 24 * time.Hour, 20 * time.Hour, 24 * time.Hour, false},
+		{"correspondence flag", daily, 24 * time.Hour, 25 * time.Hour, 0, true},
+	} {
+		remaining, flagged := chargeClock(test.tc, test.remaining, test.elapsed)
+		if remaining != test.want || flagged != test.flagged {
+			t.Errorf("%s: chargeClock = %v, %v, want %v, %v", test.name, remaining, flagged, test.want, test.flagged)
+		}
+	}
+}
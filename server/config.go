@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"time"
+)
+
+// keyPassphraseEnv names the environment variable holding the passphrase of
+// the key file, kept out of the command line and the config file.
+const keyPassphraseEnv = "SERVER_KEY_PASSPHRASE"
+
+// Config holds where the server listens and keeps its files. An address with
+// port 0 picks a free port, Start writes back the address actually bound.
+type Config struct {
+	TCPAddr            string `json:"tcp"`
+	UDPAddr            string `json:"udp"`
+	TLSAddr            string `json:"tls"`
+	WebSocketAddr      string `json:"websocket"`
+	APIAddr            string `json:"api"`
+	DBPath             string `json:"db"`
+	CertificateFile    string `json:"certificate"`
+	CertificateKeyFile string `json:"certificateKey"`
+	// KeyFile holds the server key pair and the keys being retired
+	KeyFile       string `json:"key"`
+	KeyPassphrase string `json:"-"`
+	// RotateKey replaces the server key at start, the old one is still
+	// advertised for KeyOverlap
+	RotateKey  bool          `json:"-"`
+	KeyOverlap time.Duration `json:"-"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		TCPAddr:            "localhost:8080",
+		UDPAddr:            "127.0.0.1:8081",
+		TLSAddr:            "localhost:8443",
+		WebSocketAddr:      "localhost:8082",
+		APIAddr:            "localhost:8083",
+		DBPath:             "./chess.db",
+		CertificateFile:    "./server.crt",
+		CertificateKeyFile: "./server.key",
+		KeyFile:            "./server_identity.pem",
+		KeyPassphrase:      os.Getenv(keyPassphraseEnv),
+		KeyOverlap:         7 * 24 * time.Hour,
+	}
+}
+
+// LoadConfig reads a JSON config file. Settings missing from the file keep
+// their default.
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// ParseConfig builds the config from command line arguments: the file given
+// with -config if any, overridden by the other flags.
+func ParseConfig(args []string) (Config, error) {
+	config := DefaultConfig()
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configFile := fs.String("config", "", "JSON config file")
+	fs.StringVar(&config.TCPAddr, "tcp", config.TCPAddr, "TCP listen address")
+	fs.StringVar(&config.UDPAddr, "udp", config.UDPAddr, "UDP listen address")
+	fs.StringVar(&config.TLSAddr, "tls", config.TLSAddr, "TLS listen address")
+	fs.StringVar(&config.WebSocketAddr, "websocket", config.WebSocketAddr, "WebSocket listen address")
+	fs.StringVar(&config.APIAddr, "api", config.APIAddr, "HTTP API listen address")
+	fs.StringVar(&config.DBPath, "db", config.DBPath, "SQLite database path")
+	fs.StringVar(&config.CertificateFile, "certificate", config.CertificateFile, "TLS certificate file")
+	fs.StringVar(&config.CertificateKeyFile, "certificate-key", config.CertificateKeyFile, "TLS certificate key file")
+	fs.StringVar(&config.KeyFile, "key", config.KeyFile, "server key file, encrypted when "+keyPassphraseEnv+" is set")
+	fs.BoolVar(&config.RotateKey, "rotate-key", false, "replace the server key, advertising the old one for -key-overlap")
+	fs.DurationVar(&config.KeyOverlap, "key-overlap", config.KeyOverlap, "how long a rotated key keeps being advertised")
+	err := fs.Parse(args)
+	if err != nil {
+		return Config{}, err
+	}
+	if *configFile == "" {
+		return config, nil
+	}
+
+	// Flags given on the command line win over the file
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+	config, err = LoadConfig(*configFile)
+	if err != nil {
+		return Config{}, err
+	}
+	for name, value := range set {
+		if name != "config" {
+			fs.Set(name, value)
+		}
+	}
+	return config, nil
+}
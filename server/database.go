@@ -2,28 +2,51 @@ package server
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"reseau2TP2/datatypes"
 	"time"
 )
 
-var db *chessDB
-
+// chessDB runs every query on a single goroutine, see manage.
 type chessDB struct {
-	db *sql.DB
-}
-
-var dbRequestChannel = make(chan DBRequest)
-
-func initDB() (*chessDB, error) {
+	db       *sql.DB
+	requests chan DBRequest
+}
+
+// userRecord is a row of the users table.
+type userRecord struct {
+	ID    int
+	User  datatypes.User
+	KeyID string
+}
+
+// gameRecord is a row of the games table. PGN is empty until the first move.
+type gameRecord struct {
+	ID           string
+	WhiteID      int
+	BlackID      int
+	PGN          string
+	LastMoveTime string
+	TimeControl  datatypes.TimeControl
+	// WhiteTime and BlackTime are the clocks of timed games as they were
+	// when the current turn started. TurnStarted is zero when the clock is
+	// stopped, before a timed game starts and once it is over.
+	WhiteTime   time.Duration
+	BlackTime   time.Duration
+	TurnStarted time.Time
+}
+
+func initDB(path string) (*chessDB, error) {
 	creationQuery := `CREATE TABLE IF NOT EXISTS users (
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	firstName TEXT,
 	lastName TEXT,
 	active INTEGER,
 	elo INTEGER,
-	publicKey TEXT
+	publicKey TEXT,
+	keyID TEXT
 	);
 	CREATE TABLE IF NOT EXISTS games (
 	id TEXT PRIMARY KEY,
@@ -31,11 +54,25 @@ func initDB() (*chessDB, error) {
 	blackID INTEGER,
 	pgn TEXT,
 	lastMoveTime TEXT,
+	timeControl TEXT,
+	whiteTime INTEGER,
+	blackTime INTEGER,
+	turnStarted TEXT,
 	FOREIGN KEY(whiteID) REFERENCES users(id),
 	FOREIGN KEY(blackID) REFERENCES users(id)
+	);
+	CREATE TABLE IF NOT EXISTS ratings (
+	userID INTEGER,
+	gameID TEXT,
+	eloBefore INTEGER,
+	eloAfter INTEGER,
+	time TEXT,
+	PRIMARY KEY(userID, gameID),
+	FOREIGN KEY(userID) REFERENCES users(id),
+	FOREIGN KEY(gameID) REFERENCES games(id)
 	);`
 
-	db, err := sql.Open("sqlite3", "./chess.db")
+	db, err := sql.Open("sqlite3", path)
 	if err != nil {
 		return nil, err
 	}
@@ -45,69 +82,165 @@ func initDB() (*chessDB, error) {
 		return nil, err
 	}
 
-	go dbManager()
+	err = migrateKeyIDs(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, column := range [][2]string{
+		{"timeControl", "TEXT"},
+		{"whiteTime", "INTEGER"},
+		{"blackTime", "INTEGER"},
+		{"turnStarted", "TEXT"},
+	} {
+		err = addColumn(db, "games", column[0], column[1])
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return &chessDB{db}, nil
+	return &chessDB{db: db, requests: make(chan DBRequest)}, nil
 }
 
-func dbManager() {
-	for req := range dbRequestChannel {
+// addColumn adds a column to tables created before it existed.
+func addColumn(db *sql.DB, table string, column string, columnType string) error {
+	var hasColumn bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?);`, table, column).Scan(&hasColumn)
+	if err != nil || hasColumn {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + columnType + `;`)
+	return err
+}
+
+// migrateKeyIDs adds the keyID column to databases created before it existed
+// and fills it for users that do not have one yet.
+func migrateKeyIDs(db *sql.DB) error {
+	err := addColumn(db, "users", "keyID", "TEXT")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS usersKeyID ON users(keyID);`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`SELECT id, publicKey FROM users WHERE keyID IS NULL;`)
+	if err != nil {
+		return err
+	}
+	keyIDs := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var publicKey string
+		err = rows.Scan(&id, &publicKey)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		keyID, err := datatypes.KeyIDOf(publicKey)
+		if err != nil {
+			log.Println("Skipping key ID of user", id, err)
+			continue
+		}
+		keyIDs[id] = keyID.String()
+	}
+	rows.Close()
+
+	for id, keyID := range keyIDs {
+		_, err = db.Exec(`UPDATE users SET keyID = ? WHERE id = ?;`, keyID, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manage runs the queries sent on requests one at a time, until the channel
+// is closed.
+func (d *chessDB) manage() {
+	for req := range d.requests {
 		var response DBResponse
 		switch req.QueryType {
 		case "createNewUser":
-			err := _createNewUser(req.Parameters[0].(*datatypes.User))
+			err := d._createNewUser(req.Parameters[0].(*datatypes.User))
 			response = DBResponse{Result: nil, Err: err}
 		case "getLastMoveTime":
-			lastMoveTime, err := _getLastMoveTime(req.Parameters[0].(string))
+			lastMoveTime, err := d._getLastMoveTime(req.Parameters[0].(string))
 			response = DBResponse{Result: lastMoveTime, Err: err}
-		case "getPublicKeys":
-			publicKeys, err := _getPublicKeys()
-			response = DBResponse{Result: publicKeys, Err: err}
+		case "getPlayerByKeyID":
+			playerID, publicKey, err := d._getPlayerByKeyID(req.Parameters[0].(string))
+			response = DBResponse{Result: []interface{}{playerID, publicKey}, Err: err}
 		case "getPlayerIDFromPublicKey":
-			playerID, err := _getPlayerIDFromPublicKey(req.Parameters[0].(string))
+			playerID, err := d._getPlayerIDFromPublicKey(req.Parameters[0].(string))
 			response = DBResponse{Result: playerID, Err: err}
 		case "createNewGame":
 			gameID := req.Parameters[0].(string)
 			whiteID := req.Parameters[1].(int)
 			blackID := req.Parameters[2].(int)
-			err := _createNewGame(gameID, whiteID, blackID)
+			timeControl := req.Parameters[3].(datatypes.TimeControl)
+			err := d._createNewGame(gameID, whiteID, blackID, timeControl)
 			response = DBResponse{Result: nil, Err: err}
 		case "gameExists":
-			exists := _gameExists(req.Parameters[0].(string))
+			exists := d._gameExists(req.Parameters[0].(string))
 			response = DBResponse{Result: exists, Err: nil}
 		case "getUnstartedGames":
-			games, err := _getUnstartedGames()
+			games, err := d._getUnstartedGames()
 			response = DBResponse{Result: games, Err: err}
 		case "publicKeyExists":
-			exists := _publicKeyExists(req.Parameters[0].(string))
+			exists := d._publicKeyExists(req.Parameters[0].(string))
 			response = DBResponse{Result: exists, Err: nil}
 		case "joinGame":
-			err := _joinGame(req.Parameters[0].(string), req.Parameters[1].(int))
+			err := d._joinGame(req.Parameters[0].(string), req.Parameters[1].(int))
 			response = DBResponse{Result: nil, Err: err}
 		case "getGames":
-			games, err := _getGames()
+			games, err := d._getGames()
 			response = DBResponse{Result: games, Err: err}
 		case "getGamesByPlayerID":
-			games, err := _getGamesByPlayerID(req.Parameters[0].(int))
+			games, err := d._getGamesByPlayerID(req.Parameters[0].(int))
 			response = DBResponse{Result: games, Err: err}
 		case "getPGN":
-			pgn, err := _getPGN(req.Parameters[0].(string))
+			pgn, err := d._getPGN(req.Parameters[0].(string))
 			response = DBResponse{Result: pgn, Err: err}
 		case "findActiveGame":
-			gameID, err := _findActiveGame(req.Parameters[0].(int))
+			gameID, err := d._findActiveGame(req.Parameters[0].(int))
 			response = DBResponse{Result: gameID, Err: err}
+		case "saveClocks":
+			err := d._saveClocks(req.Parameters[0].(gameRecord))
+			response = DBResponse{Result: nil, Err: err}
+		case "getRunningClocks":
+			games, err := d._getRunningClocks()
+			response = DBResponse{Result: games, Err: err}
 		case "saveGame":
-			err := _saveGame(req.Parameters[0].(string), req.Parameters[1].(string))
+			err := d._saveGame(req.Parameters[0].(string), req.Parameters[1].(string))
 			response = DBResponse{Result: nil, Err: err}
 		case "getPlayerPublicKey":
-			publicKey, err := _getPlayerPublicKey(req.Parameters[0].(int))
+			publicKey, err := d._getPlayerPublicKey(req.Parameters[0].(int))
 			response = DBResponse{Result: publicKey, Err: err}
 		case "getWhitePlayerID":
-			whiteID, err := _getWhitePlayerID(req.Parameters[0].(string))
+			whiteID, err := d._getWhitePlayerID(req.Parameters[0].(string))
 			response = DBResponse{Result: whiteID, Err: err}
 		case "getBlackPlayerID":
-			blackID, err := _getBlackPlayerID(req.Parameters[0].(string))
+			blackID, err := d._getBlackPlayerID(req.Parameters[0].(string))
 			response = DBResponse{Result: blackID, Err: err}
+		case "getUsers":
+			users, err := d._getUsers()
+			response = DBResponse{Result: users, Err: err}
+		case "getUser":
+			user, err := d._getUser(req.Parameters[0].(int))
+			response = DBResponse{Result: user, Err: err}
+		case "getGame":
+			game, err := d._getGame(req.Parameters[0].(string))
+			response = DBResponse{Result: game, Err: err}
+		case "updateProfile":
+			user, err := d._updateProfile(req.Parameters[0].(int), req.Parameters[1].(datatypes.ProfileUpdate))
+			response = DBResponse{Result: user, Err: err}
+		case "rateGame":
+			gameID := req.Parameters[0].(string)
+			whiteID := req.Parameters[1].(int)
+			blackID := req.Parameters[2].(int)
+			score := req.Parameters[3].(float64)
+			changes, err := d._rateGame(gameID, whiteID, blackID, score)
+			response = DBResponse{Result: changes, Err: err}
 		default:
 			response = DBResponse{Err: fmt.Errorf("unknown query type")}
 		}
@@ -115,23 +248,28 @@ func dbManager() {
 	}
 }
 
-func _createNewUser(u *datatypes.User) error {
-	_, err := db.db.Exec(`INSERT INTO users
+func (d *chessDB) _createNewUser(u *datatypes.User) error {
+	keyID, err := datatypes.KeyIDOf(u.PublicKey)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(`INSERT INTO users
 		(
 		firstName,
 		lastName,
 		active,
 		elo,
-		publicKey
+		publicKey,
+		keyID
 		)
-		VALUES (?, ?, ?, ?, ?);`,
-		u.FirstName, u.LastName, u.IsActive, u.Elo, u.PublicKey)
+		VALUES (?, ?, ?, ?, ?, ?);`,
+		u.FirstName, u.LastName, u.IsActive, u.Elo, u.PublicKey, keyID.String())
 	return err
 }
 
-func createNewUser(u *datatypes.User) error {
+func (d *chessDB) createNewUser(u *datatypes.User) error {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "createNewUser",
 		Parameters: []interface{}{u},
 		Response:   responseChannel,
@@ -143,18 +281,18 @@ func createNewUser(u *datatypes.User) error {
 	return nil
 }
 
-func _getLastMoveTime(gameID string) (string, error) {
+func (d *chessDB) _getLastMoveTime(gameID string) (string, error) {
 	var lastMoveTime string
-	err := db.db.QueryRow(`SELECT lastMoveTime FROM games WHERE id = ?;`, gameID).Scan(&lastMoveTime)
+	err := d.db.QueryRow(`SELECT lastMoveTime FROM games WHERE id = ?;`, gameID).Scan(&lastMoveTime)
 	if err != nil {
 		return "", err
 	}
 	return lastMoveTime, nil
 }
 
-func getLastMoveTime(gameID string) (string, error) {
+func (d *chessDB) getLastMoveTime(gameID string) (string, error) {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "getLastMoveTime",
 		Parameters: []interface{}{gameID},
 		Response:   responseChannel,
@@ -166,49 +304,40 @@ func getLastMoveTime(gameID string) (string, error) {
 	return response.Result.(string), nil
 }
 
-func _getPublicKeys() ([]string, error) {
-	rows, err := db.db.Query(`SELECT publicKey FROM users;`)
+func (d *chessDB) _getPlayerByKeyID(keyID string) (int, string, error) {
+	var playerID int
+	var publicKey string
+	err := d.db.QueryRow(`SELECT id, publicKey FROM users WHERE keyID = ?;`, keyID).Scan(&playerID, &publicKey)
 	if err != nil {
-		return nil, err
-	}
-	var publicKeys []string
-	for rows.Next() {
-		var publicKey string
-		err = rows.Scan(&publicKey)
-		if err != nil {
-			return nil, err
-		}
-		publicKeys = append(publicKeys, publicKey)
+		return -1, "", err
 	}
-	return publicKeys, nil
+	return playerID, publicKey, nil
 }
 
-func getPublicKeys() ([]string, error) {
+func (d *chessDB) getPlayerByKeyID(keyID string) (int, string, error) {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
-		QueryType:  "getPublicKeys",
-		Parameters: []interface{}{},
+	d.requests <- DBRequest{
+		QueryType:  "getPlayerByKeyID",
+		Parameters: []interface{}{keyID},
 		Response:   responseChannel,
 	}
 	response := <-responseChannel
-	if response.Err != nil {
-		return response.Result.([]string), response.Err
-	}
-	return response.Result.([]string), nil
+	result := response.Result.([]interface{})
+	return result[0].(int), result[1].(string), response.Err
 }
 
-func _getPlayerIDFromPublicKey(publicKey string) (int, error) {
+func (d *chessDB) _getPlayerIDFromPublicKey(publicKey string) (int, error) {
 	var playerID int
-	err := db.db.QueryRow(`SELECT id FROM users WHERE publicKey = ?;`, publicKey).Scan(&playerID)
+	err := d.db.QueryRow(`SELECT id FROM users WHERE publicKey = ?;`, publicKey).Scan(&playerID)
 	if err != nil {
 		return -1, err
 	}
 	return playerID, nil
 }
 
-func getPlayerIDFromPublicKey(publicKey string) int {
+func (d *chessDB) getPlayerIDFromPublicKey(publicKey string) int {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "getPlayerIDFromPublicKey",
 		Parameters: []interface{}{publicKey},
 		Response:   responseChannel,
@@ -220,46 +349,57 @@ func getPlayerIDFromPublicKey(publicKey string) int {
 	return response.Result.(int)
 }
 
-func _createNewGame(gameID string, whiteID int, blackID int) error {
-	_, err := db.db.Exec(`INSERT INTO games
+// _createNewGame creates a game. The clock of a timed game starts right away
+// when it is created with both players, or once its opponent joins.
+func (d *chessDB) _createNewGame(gameID string, whiteID int, blackID int, timeControl datatypes.TimeControl) error {
+	var clock, turnStarted interface{}
+	if timeControl.Timed() {
+		clock = timeControl.InitialTime().Milliseconds()
+	}
+	if timeControl.Timed() && blackID != -1 {
+		turnStarted = time.Now().Format(time.RFC3339Nano)
+	}
+	_, err := d.db.Exec(`INSERT INTO games
 		(
 		id,
 		whiteID,
 		blackID,
 		pgn,
-		lastMoveTime
+		lastMoveTime,
+		timeControl,
+		whiteTime,
+		blackTime,
+		turnStarted
 		)
-		VALUES (?, ?, ?, ?, ?);`,
-		gameID, whiteID, blackID, nil, time.Now().Format("2006-01-02 15:04:05"))
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`,
+		gameID, whiteID, blackID, nil, time.Now().Format("2006-01-02 15:04:05"), timeControl.String(),
+		clock, clock, turnStarted)
 	return err
 }
 
-func createNewGame(gameID string, whiteID int, blackID int) {
+func (d *chessDB) createNewGame(gameID string, whiteID int, blackID int, timeControl datatypes.TimeControl) error {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "createNewGame",
-		Parameters: []interface{}{gameID, whiteID, blackID},
+		Parameters: []interface{}{gameID, whiteID, blackID, timeControl},
 		Response:   responseChannel,
 	}
 	response := <-responseChannel
-	if response.Err != nil {
-		return
-	}
-	return
+	return response.Err
 }
 
-func _gameExists(gameID string) bool {
+func (d *chessDB) _gameExists(gameID string) bool {
 	var exists bool
-	err := db.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM games WHERE id = ?);`, gameID).Scan(&exists)
+	err := d.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM games WHERE id = ?);`, gameID).Scan(&exists)
 	if err != nil {
 		return false
 	}
 	return exists
 }
 
-func gameExists(gameID string) bool {
+func (d *chessDB) gameExists(gameID string) bool {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "gameExists",
 		Parameters: []interface{}{gameID},
 		Response:   responseChannel,
@@ -268,17 +408,33 @@ func gameExists(gameID string) bool {
 	return response.Result.(bool)
 }
 
-func _joinGame(gameID string, playerID int) error {
-	_, err := db.db.Exec(`UPDATE games
-		SET blackID = ?
-		WHERE id = ?;`,
-		playerID, gameID)
-	return err
+// errGameNotJoinable is returned by joinGame for games that already have
+// both players, solo games included.
+var errGameNotJoinable = errors.New("game not joinable")
+
+// _joinGame also starts the clock of a timed game.
+func (d *chessDB) _joinGame(gameID string, playerID int) error {
+	result, err := d.db.Exec(`UPDATE games
+		SET blackID = ?,
+		turnStarted = CASE WHEN whiteTime IS NULL THEN NULL ELSE ? END
+		WHERE id = ? AND blackID = -1;`,
+		playerID, time.Now().Format(time.RFC3339Nano), gameID)
+	if err != nil {
+		return err
+	}
+	joined, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if joined == 0 {
+		return errGameNotJoinable
+	}
+	return nil
 }
 
-func joinGame(gameID string, playerID int) error {
+func (d *chessDB) joinGame(gameID string, playerID int) error {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "joinGame",
 		Parameters: []interface{}{gameID, playerID},
 		Response:   responseChannel,
@@ -287,49 +443,47 @@ func joinGame(gameID string, playerID int) error {
 	return response.Err
 }
 
-func _getUnstartedGames() ([]string, error) {
-	rows, err := db.db.Query(`SELECT id FROM games WHERE blackID = -1;`)
+func (d *chessDB) _getUnstartedGames() ([]string, error) {
+	rows, err := d.db.Query(`SELECT id FROM games WHERE blackID = -1;`)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	var games []string
 	for rows.Next() {
 		var gameID string
 		err = rows.Scan(&gameID)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		games = append(games, gameID)
 	}
-	return games, nil
+	return games, rows.Err()
 }
 
-func getUnstartedGames() []string {
+func (d *chessDB) getUnstartedGames() ([]string, error) {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "getUnstartedGames",
 		Parameters: []interface{}{},
 		Response:   responseChannel,
 	}
 	response := <-responseChannel
-	if response.Err != nil {
-		return response.Result.([]string)
-	}
-	return response.Result.([]string)
+	return response.Result.([]string), response.Err
 }
 
-func _publicKeyExists(publicKey string) bool {
+func (d *chessDB) _publicKeyExists(publicKey string) bool {
 	var exists bool
-	err := db.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE publicKey = ?);`, publicKey).Scan(&exists)
+	err := d.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE publicKey = ?);`, publicKey).Scan(&exists)
 	if err != nil {
 		return false
 	}
 	return exists
 }
 
-func publicKeyExists(publicKey string) bool {
+func (d *chessDB) publicKeyExists(publicKey string) bool {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "publicKeyExists",
 		Parameters: []interface{}{publicKey},
 		Response:   responseChannel,
@@ -338,57 +492,56 @@ func publicKeyExists(publicKey string) bool {
 	return response.Result.(bool)
 }
 
-func _getGames() ([]string, error) {
-	rows, err := db.db.Query(`SELECT id FROM games;`)
+func (d *chessDB) _getGames() ([]string, error) {
+	rows, err := d.db.Query(`SELECT id FROM games;`)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	var games []string
 	for rows.Next() {
 		var gameID string
 		err = rows.Scan(&gameID)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		games = append(games, gameID)
 	}
-	return games, nil
+	return games, rows.Err()
 }
 
-func getGames() []string {
+func (d *chessDB) getGames() ([]string, error) {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "getGames",
 		Parameters: []interface{}{},
 		Response:   responseChannel,
 	}
 	response := <-responseChannel
-	if response.Err != nil {
-		return response.Result.([]string)
-	}
-	return response.Result.([]string)
+	return response.Result.([]string), response.Err
 }
 
-func _getGamesByPlayerID(playerID int) ([]string, error) {
-	rows, err := db.db.Query(`SELECT id FROM games WHERE whiteID = ? OR blackID = ?;`, playerID, playerID)
+func (d *chessDB) _getGamesByPlayerID(playerID int) ([]string, error) {
+	rows, err := d.db.Query(`SELECT id FROM games WHERE whiteID = ? OR blackID = ?;`, playerID, playerID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	var games []string
 	for rows.Next() {
 		var gameID string
 		err = rows.Scan(&gameID)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		games = append(games, gameID)
 	}
-	return games, nil
+	return games, rows.Err()
 }
 
-func getGamesByPlayerID(playerID int) ([]string, error) {
+func (d *chessDB) getGamesByPlayerID(playerID int) ([]string, error) {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "getGamesByPlayerID",
 		Parameters: []interface{}{playerID},
 		Response:   responseChannel,
@@ -397,18 +550,18 @@ func getGamesByPlayerID(playerID int) ([]string, error) {
 	return response.Result.([]string), response.Err
 }
 
-func _getPGN(gameID string) (string, error) {
+func (d *chessDB) _getPGN(gameID string) (string, error) {
 	var pgn string
-	err := db.db.QueryRow(`SELECT pgn FROM games WHERE id = ?;`, gameID).Scan(&pgn)
+	err := d.db.QueryRow(`SELECT pgn FROM games WHERE id = ?;`, gameID).Scan(&pgn)
 	if err != nil {
 		return "", err
 	}
 	return pgn, nil
 }
 
-func getPGN(gameID string) (string, error) {
+func (d *chessDB) getPGN(gameID string) (string, error) {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "getPGN",
 		Parameters: []interface{}{gameID},
 		Response:   responseChannel,
@@ -417,11 +570,12 @@ func getPGN(gameID string) (string, error) {
 	return response.Result.(string), response.Err
 }
 
-func _findActiveGame(playerID int) (string, error) {
-	rows, err := db.db.Query(`SELECT id FROM games WHERE whiteID = ? OR blackID = ? ORDER BY lastMoveTime DESC LIMIT 1;`, playerID, playerID)
+func (d *chessDB) _findActiveGame(playerID int) (string, error) {
+	rows, err := d.db.Query(`SELECT id FROM games WHERE whiteID = ? OR blackID = ? ORDER BY lastMoveTime DESC, rowid DESC LIMIT 1;`, playerID, playerID)
 	if err != nil {
 		return "", err
 	}
+	defer rows.Close()
 	var gameID string
 	for rows.Next() {
 		err = rows.Scan(&gameID)
@@ -429,12 +583,12 @@ func _findActiveGame(playerID int) (string, error) {
 			return "", err
 		}
 	}
-	return gameID, nil
+	return gameID, rows.Err()
 }
 
-func findActiveGame(playerID int) (string, error) {
+func (d *chessDB) findActiveGame(playerID int) (string, error) {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "findActiveGame",
 		Parameters: []interface{}{playerID},
 		Response:   responseChannel,
@@ -443,8 +597,8 @@ func findActiveGame(playerID int) (string, error) {
 	return response.Result.(string), response.Err
 }
 
-func _saveGame(gameID string, pgn string) error {
-	_, err := db.db.Exec(`UPDATE games
+func (d *chessDB) _saveGame(gameID string, pgn string) error {
+	_, err := d.db.Exec(`UPDATE games
 		SET pgn = ?,
 		lastMoveTime = ?
 		WHERE id = ?;`,
@@ -452,9 +606,9 @@ func _saveGame(gameID string, pgn string) error {
 	return err
 }
 
-func saveGame(gameID string, pgn string) error {
+func (d *chessDB) saveGame(gameID string, pgn string) error {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "saveGame",
 		Parameters: []interface{}{gameID, pgn},
 		Response:   responseChannel,
@@ -463,18 +617,71 @@ func saveGame(gameID string, pgn string) error {
 	return response.Err
 }
 
-func _getPlayerPublicKey(playerID int) (string, error) {
+// _saveClocks saves the clocks of game, stopping the clock when
+// game.TurnStarted is zero.
+func (d *chessDB) _saveClocks(game gameRecord) error {
+	var turnStarted interface{}
+	if !game.TurnStarted.IsZero() {
+		turnStarted = game.TurnStarted.Format(time.RFC3339Nano)
+	}
+	_, err := d.db.Exec(`UPDATE games SET whiteTime = ?, blackTime = ?, turnStarted = ? WHERE id = ?;`,
+		game.WhiteTime.Milliseconds(), game.BlackTime.Milliseconds(), turnStarted, game.ID)
+	return err
+}
+
+func (d *chessDB) saveClocks(game gameRecord) error {
+	responseChannel := make(chan DBResponse)
+	d.requests <- DBRequest{
+		QueryType:  "saveClocks",
+		Parameters: []interface{}{game},
+		Response:   responseChannel,
+	}
+	response := <-responseChannel
+	return response.Err
+}
+
+// _getRunningClocks returns the games whose clock is running.
+func (d *chessDB) _getRunningClocks() ([]string, error) {
+	rows, err := d.db.Query(`SELECT id FROM games WHERE turnStarted IS NOT NULL;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var games []string
+	for rows.Next() {
+		var gameID string
+		err = rows.Scan(&gameID)
+		if err != nil {
+			return nil, err
+		}
+		games = append(games, gameID)
+	}
+	return games, rows.Err()
+}
+
+func (d *chessDB) getRunningClocks() ([]string, error) {
+	responseChannel := make(chan DBResponse)
+	d.requests <- DBRequest{
+		QueryType:  "getRunningClocks",
+		Parameters: []interface{}{},
+		Response:   responseChannel,
+	}
+	response := <-responseChannel
+	return response.Result.([]string), response.Err
+}
+
+func (d *chessDB) _getPlayerPublicKey(playerID int) (string, error) {
 	var publicKey string
-	err := db.db.QueryRow(`SELECT publicKey FROM users WHERE id = ?;`, playerID).Scan(&publicKey)
+	err := d.db.QueryRow(`SELECT publicKey FROM users WHERE id = ?;`, playerID).Scan(&publicKey)
 	if err != nil {
 		return "", err
 	}
 	return publicKey, nil
 }
 
-func getPlayerPublicKey(playerID int) (string, error) {
+func (d *chessDB) getPlayerPublicKey(playerID int) (string, error) {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "getPlayerPublicKey",
 		Parameters: []interface{}{playerID},
 		Response:   responseChannel,
@@ -483,18 +690,18 @@ func getPlayerPublicKey(playerID int) (string, error) {
 	return response.Result.(string), response.Err
 }
 
-func _getWhitePlayerID(gameID string) (int, error) {
+func (d *chessDB) _getWhitePlayerID(gameID string) (int, error) {
 	var whiteID int
-	err := db.db.QueryRow(`SELECT whiteID FROM games WHERE id = ?;`, gameID).Scan(&whiteID)
+	err := d.db.QueryRow(`SELECT whiteID FROM games WHERE id = ?;`, gameID).Scan(&whiteID)
 	if err != nil {
 		return -1, err
 	}
 	return whiteID, nil
 }
 
-func getWhitePlayerID(gameID string) (int, error) {
+func (d *chessDB) getWhitePlayerID(gameID string) (int, error) {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "getWhitePlayerID",
 		Parameters: []interface{}{gameID},
 		Response:   responseChannel,
@@ -503,18 +710,18 @@ func getWhitePlayerID(gameID string) (int, error) {
 	return response.Result.(int), response.Err
 }
 
-func _getBlackPlayerID(gameID string) (int, error) {
+func (d *chessDB) _getBlackPlayerID(gameID string) (int, error) {
 	var blackID int
-	err := db.db.QueryRow(`SELECT blackID FROM games WHERE id = ?;`, gameID).Scan(&blackID)
+	err := d.db.QueryRow(`SELECT blackID FROM games WHERE id = ?;`, gameID).Scan(&blackID)
 	if err != nil {
 		return -1, err
 	}
 	return blackID, nil
 }
 
-func getBlackPlayerID(gameID string) (int, error) {
+func (d *chessDB) getBlackPlayerID(gameID string) (int, error) {
 	responseChannel := make(chan DBResponse)
-	dbRequestChannel <- DBRequest{
+	d.requests <- DBRequest{
 		QueryType:  "getBlackPlayerID",
 		Parameters: []interface{}{gameID},
 		Response:   responseChannel,
@@ -522,3 +729,212 @@ func getBlackPlayerID(gameID string) (int, error) {
 	response := <-responseChannel
 	return response.Result.(int), response.Err
 }
+
+func (d *chessDB) _getUsers() ([]userRecord, error) {
+	rows, err := d.db.Query(`SELECT id, firstName, lastName, active, elo, publicKey, keyID FROM users;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []userRecord
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (d *chessDB) getUsers() ([]userRecord, error) {
+	responseChannel := make(chan DBResponse)
+	d.requests <- DBRequest{
+		QueryType:  "getUsers",
+		Parameters: []interface{}{},
+		Response:   responseChannel,
+	}
+	response := <-responseChannel
+	return response.Result.([]userRecord), response.Err
+}
+
+func (d *chessDB) _getUser(playerID int) (userRecord, error) {
+	row := d.db.QueryRow(`SELECT id, firstName, lastName, active, elo, publicKey, keyID FROM users WHERE id = ?;`, playerID)
+	return scanUser(row)
+}
+
+func (d *chessDB) getUser(playerID int) (userRecord, error) {
+	responseChannel := make(chan DBResponse)
+	d.requests <- DBRequest{
+		QueryType:  "getUser",
+		Parameters: []interface{}{playerID},
+		Response:   responseChannel,
+	}
+	response := <-responseChannel
+	return response.Result.(userRecord), response.Err
+}
+
+// scanUser reads a user selected with all its columns, from a *sql.Row or
+// *sql.Rows.
+func scanUser(row interface{ Scan(...any) error }) (userRecord, error) {
+	var user userRecord
+	var keyID sql.NullString
+	err := row.Scan(&user.ID, &user.User.FirstName, &user.User.LastName, &user.User.IsActive, &user.User.Elo, &user.User.PublicKey, &keyID)
+	if err != nil {
+		return userRecord{}, err
+	}
+	user.KeyID = keyID.String
+	return user, nil
+}
+
+func (d *chessDB) _getGame(gameID string) (gameRecord, error) {
+	var game gameRecord
+	var pgn, timeControl, turnStarted sql.NullString
+	var whiteTime, blackTime sql.NullInt64
+	err := d.db.QueryRow(`SELECT id, whiteID, blackID, pgn, lastMoveTime, timeControl, whiteTime, blackTime, turnStarted
+		FROM games WHERE id = ?;`, gameID).
+		Scan(&game.ID, &game.WhiteID, &game.BlackID, &pgn, &game.LastMoveTime, &timeControl, &whiteTime, &blackTime, &turnStarted)
+	if err != nil {
+		return gameRecord{}, err
+	}
+	game.PGN = pgn.String
+	game.TimeControl, err = datatypes.ParseTimeControl(timeControl.String)
+	if err != nil {
+		return gameRecord{}, err
+	}
+	game.WhiteTime = time.Duration(whiteTime.Int64) * time.Millisecond
+	game.BlackTime = time.Duration(blackTime.Int64) * time.Millisecond
+	if turnStarted.Valid {
+		game.TurnStarted, err = time.Parse(time.RFC3339Nano, turnStarted.String)
+		if err != nil {
+			return gameRecord{}, err
+		}
+	}
+	return game, nil
+}
+
+func (d *chessDB) getGame(gameID string) (gameRecord, error) {
+	responseChannel := make(chan DBResponse)
+	d.requests <- DBRequest{
+		QueryType:  "getGame",
+		Parameters: []interface{}{gameID},
+		Response:   responseChannel,
+	}
+	response := <-responseChannel
+	return response.Result.(gameRecord), response.Err
+}
+
+// _rateGame applies the result of a game to the ratings of both players and
+// records it in the rating history, in one transaction. score is the score of
+// white. A game is rated once: rating it again returns the recorded changes.
+func (d *chessDB) _rateGame(gameID string, whiteID int, blackID int, score float64) (map[int]ratingChange, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	changes := make(map[int]ratingChange)
+	rows, err := tx.Query(`SELECT userID, eloBefore, eloAfter FROM ratings WHERE gameID = ?;`, gameID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var userID int
+		var change ratingChange
+		err = rows.Scan(&userID, &change.Before, &change.After)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		changes[userID] = change
+	}
+	rows.Close()
+	if len(changes) > 0 {
+		return changes, nil
+	}
+
+	ratings := make(map[int]int)
+	games := make(map[int]int)
+	for _, playerID := range []int{whiteID, blackID} {
+		var rating, count int
+		err = tx.QueryRow(`SELECT elo FROM users WHERE id = ?;`, playerID).Scan(&rating)
+		if err != nil {
+			return nil, err
+		}
+		err = tx.QueryRow(`SELECT COUNT(*) FROM ratings WHERE userID = ?;`, playerID).Scan(&count)
+		if err != nil {
+			return nil, err
+		}
+		ratings[playerID] = rating
+		games[playerID] = count
+	}
+	changes[whiteID] = ratingChange{
+		Before: ratings[whiteID],
+		After:  newRating(ratings[whiteID], games[whiteID], ratings[blackID], score),
+	}
+	changes[blackID] = ratingChange{
+		Before: ratings[blackID],
+		After:  newRating(ratings[blackID], games[blackID], ratings[whiteID], 1-score),
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	for playerID, change := range changes {
+		_, err = tx.Exec(`UPDATE users SET elo = ? WHERE id = ?;`, change.After, playerID)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`INSERT INTO ratings (userID, gameID, eloBefore, eloAfter, time) VALUES (?, ?, ?, ?, ?);`,
+			playerID, gameID, change.Before, change.After, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return changes, tx.Commit()
+}
+
+func (d *chessDB) rateGame(gameID string, whiteID int, blackID int, score float64) (map[int]ratingChange, error) {
+	responseChannel := make(chan DBResponse)
+	d.requests <- DBRequest{
+		QueryType:  "rateGame",
+		Parameters: []interface{}{gameID, whiteID, blackID, score},
+		Response:   responseChannel,
+	}
+	response := <-responseChannel
+	return response.Result.(map[int]ratingChange), response.Err
+}
+
+// _updateProfile applies update to the profile of playerID and returns the
+// profile updated.
+func (d *chessDB) _updateProfile(playerID int, update datatypes.ProfileUpdate) (userRecord, error) {
+	user, err := d._getUser(playerID)
+	if err != nil {
+		return userRecord{}, err
+	}
+	if update.FirstName != "" {
+		user.User.FirstName = update.FirstName
+	}
+	if update.LastName != "" {
+		user.User.LastName = update.LastName
+	}
+	if update.IsActive != nil {
+		user.User.IsActive = *update.IsActive
+	}
+	_, err = d.db.Exec(`UPDATE users SET firstName = ?, lastName = ?, active = ? WHERE id = ?;`,
+		user.User.FirstName, user.User.LastName, user.User.IsActive, playerID)
+	if err != nil {
+		return userRecord{}, err
+	}
+	return user, nil
+}
+
+func (d *chessDB) updateProfile(playerID int, update datatypes.ProfileUpdate) (userRecord, error) {
+	responseChannel := make(chan DBResponse)
+	d.requests <- DBRequest{
+		QueryType:  "updateProfile",
+		Parameters: []interface{}{playerID, update},
+		Response:   responseChannel,
+	}
+	response := <-responseChannel
+	return response.Result.(userRecord), response.Err
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reseau2TP2/datatypes"
+	"time"
+
+	"github.com/notnil/chess"
+)
+
+var (
+	errNoDrawOffer      = errors.New("no draw offered")
+	errDrawNotClaimable = errors.New("draw cannot be claimed")
+)
+
+// color is the color playerID plays in record. Solo players are white.
+func (r gameRecord) color(playerID int) chess.Color {
+	if playerID == r.WhiteID {
+		return chess.White
+	}
+	return chess.Black
+}
+
+// player is the player playing color in record.
+func (r gameRecord) player(color chess.Color) int {
+	if color == chess.Black {
+		return r.BlackID
+	}
+	return r.WhiteID
+}
+
+// opponent is the player playerID plays against in record.
+func (r gameRecord) opponent(playerID int) int {
+	if playerID == r.WhiteID {
+		return r.BlackID
+	}
+	return r.WhiteID
+}
+
+func (srv *Server) handleResign(s *session, tlv datatypes.TLV) {
+	log.Println("Resign")
+	playerID, ok := srv.authenticate(s, &tlv, true)
+	if !ok {
+		return
+	}
+	gameID, game, ok := srv.activeGame(s, tlv, playerID)
+	if !ok {
+		return
+	}
+
+	srv.endGame(s, tlv, playerID, gameID, game, func(record gameRecord) (chess.Method, error) {
+		game.Resign(record.color(playerID))
+		return chess.Resignation, nil
+	})
+}
+
+// handleOfferDraw offers a draw to the opponent, pushed with DrawOfferTag.
+// The offer stands until it is answered or a move is played. Offering a draw
+// to a player who offered one accepts it. The AI never accepts a draw.
+func (srv *Server) handleOfferDraw(s *session, tlv datatypes.TLV) {
+	log.Println("OfferDraw")
+	playerID, ok := srv.authenticate(s, &tlv, true)
+	if !ok {
+		return
+	}
+	gameID, game, ok := srv.activeGame(s, tlv, playerID)
+	if !ok {
+		return
+	}
+	blackID, err := srv.db.getBlackPlayerID(gameID)
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not load players")
+		return
+	}
+	if blackID == 0 {
+		sendError(s, tlv, datatypes.CodeDrawNotOfferable, "The AI does not accept draws")
+		return
+	}
+
+	srv.clocksMutex.Lock()
+	offeredBy, offered := srv.drawOffers[gameID]
+	srv.clocksMutex.Unlock()
+	if offered && offeredBy != playerID {
+		srv.endGame(s, tlv, playerID, gameID, game, srv.agreeDraw(gameID, game, playerID))
+		return
+	}
+
+	srv.clocksMutex.Lock()
+	record, err := srv.db.getGame(gameID)
+	if err == nil && gameOver(record, game) {
+		err = errGameOver
+	}
+	if err == nil {
+		srv.drawOffers[gameID] = playerID
+	}
+	srv.clocksMutex.Unlock()
+	if errors.Is(err, errGameOver) {
+		sendError(s, tlv, datatypes.CodeInvalidMove, "Game is over")
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not load game")
+		return
+	}
+
+	sendEncrypted(s, tlv.ID, 0x82, datatypes.Status{Message: "Draw offered"}.Marshal(s.version), s.playerPublicKey)
+	srv.pushStatus(record.opponent(playerID), datatypes.DrawOfferTag, "Draw offered")
+}
+
+// handleAnswerDraw accepts or declines the draw offered by the opponent. The
+// decline is pushed to them with DrawDeclinedTag.
+func (srv *Server) handleAnswerDraw(s *session, tlv datatypes.TLV) {
+	log.Println("AnswerDraw")
+	playerID, ok := srv.authenticate(s, &tlv, true)
+	if !ok {
+		return
+	}
+	var answer datatypes.DrawAnswer
+	err := answer.Unmarshal(tlv.Value)
+	if err != nil {
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Malformed draw answer")
+		return
+	}
+	gameID, game, ok := srv.activeGame(s, tlv, playerID)
+	if !ok {
+		return
+	}
+
+	if answer.Accept {
+		srv.endGame(s, tlv, playerID, gameID, game, srv.agreeDraw(gameID, game, playerID))
+		return
+	}
+
+	srv.clocksMutex.Lock()
+	offeredBy, offered := srv.drawOffers[gameID]
+	offered = offered && offeredBy != playerID
+	if offered {
+		delete(srv.drawOffers, gameID)
+	}
+	srv.clocksMutex.Unlock()
+	if !offered {
+		sendError(s, tlv, datatypes.CodeNoDrawOffer, "No draw offered")
+		return
+	}
+
+	sendEncrypted(s, tlv.ID, 0x82, datatypes.Status{Message: "Draw declined"}.Marshal(s.version), s.playerPublicKey)
+	srv.pushStatus(offeredBy, datatypes.DrawDeclinedTag, "Draw declined")
+}
+
+// handleClaimDraw draws the game by threefold repetition or the fifty-move
+// rule, when the position allows it.
+func (srv *Server) handleClaimDraw(s *session, tlv datatypes.TLV) {
+	log.Println("ClaimDraw")
+	playerID, ok := srv.authenticate(s, &tlv, true)
+	if !ok {
+		return
+	}
+	var claim datatypes.DrawClaim
+	err := claim.Unmarshal(tlv.Value)
+	if err != nil {
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Malformed draw claim")
+		return
+	}
+	var method chess.Method
+	switch claim.Reason {
+	case datatypes.ThreefoldRepetition:
+		method = chess.ThreefoldRepetition
+	case datatypes.FiftyMoveRule:
+		method = chess.FiftyMoveRule
+	default:
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Unknown draw reason")
+		return
+	}
+	gameID, game, ok := srv.activeGame(s, tlv, playerID)
+	if !ok {
+		return
+	}
+
+	srv.endGame(s, tlv, playerID, gameID, game, func(gameRecord) (chess.Method, error) {
+		err := game.Draw(method)
+		if err != nil {
+			return chess.NoMethod, fmt.Errorf("%w: %v", errDrawNotClaimable, err)
+		}
+		return method, nil
+	})
+}
+
+// agreeDraw draws game when the opponent of playerID offered it.
+func (srv *Server) agreeDraw(gameID string, game *chess.Game, playerID int) func(gameRecord) (chess.Method, error) {
+	return func(gameRecord) (chess.Method, error) {
+		if offeredBy, offered := srv.drawOffers[gameID]; !offered || offeredBy == playerID {
+			return chess.NoMethod, errNoDrawOffer
+		}
+		game.Draw(chess.DrawOffer)
+		return chess.DrawOffer, nil
+	}
+}
+
+// endGame ends the game playerID asked to end with request, then pushes the
+// result to their opponent. end ends game and returns how, or why it could
+// not. It runs under clocksMutex once the game is known not to be over.
+func (srv *Server) endGame(s *session, request datatypes.TLV, playerID int, gameID string, game *chess.Game, end func(gameRecord) (chess.Method, error)) {
+	record, err := srv.finishGame(gameID, game, end)
+	switch {
+	case errors.Is(err, errGameOver):
+		sendError(s, request, datatypes.CodeInvalidMove, "Game is over")
+		return
+	case errors.Is(err, errNoDrawOffer):
+		sendError(s, request, datatypes.CodeNoDrawOffer, "No draw offered")
+		return
+	case errors.Is(err, errDrawNotClaimable):
+		log.Println(err)
+		sendError(s, request, datatypes.CodeDrawNotClaimable, "Draw cannot be claimed")
+		return
+	case err != nil:
+		log.Println(err)
+		sendError(s, request, datatypes.CodeInternal, "Could not save game")
+		return
+	}
+	srv.publishEnd(gameID, game)
+
+	ratings := srv.rateGame(gameID, game)
+	sendEncrypted(s, request.ID, 0x80, moveUpdate(s, record, game, ratings[playerID]), s.playerPublicKey)
+	srv.notifyOpponent(record, game, playerID, ratings)
+}
+
+// finishGame ends game with end and saves it with the way it ended, which
+// its PGN would not keep otherwise, see endMethod. The clock of a timed game
+// stops.
+func (srv *Server) finishGame(gameID string, game *chess.Game, end func(gameRecord) (chess.Method, error)) (gameRecord, error) {
+	srv.clocksMutex.Lock()
+	defer srv.clocksMutex.Unlock()
+
+	record, err := srv.db.getGame(gameID)
+	if err != nil {
+		return gameRecord{}, err
+	}
+	if gameOver(record, game) {
+		return record, errGameOver
+	}
+	method, err := end(record)
+	if err != nil {
+		return record, err
+	}
+	game.AddTagPair("Termination", method.String())
+	delete(srv.drawOffers, gameID)
+
+	err = srv.db.saveGame(gameID, game.String())
+	if err != nil || record.TurnStarted.IsZero() {
+		return record, err
+	}
+	record.TurnStarted = time.Time{}
+	srv.armClock(record, game.Position().Turn())
+	return record, srv.db.saveClocks(record)
+}
+
+// pushStatus pushes message to playerID with tag, if connected.
+func (srv *Server) pushStatus(playerID int, tag uint8, message string) {
+	pbKey, _ := srv.db.getPlayerPublicKey(playerID)
+	player, err := srv.getConnectionForPlayer(pbKey)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	sendEncrypted(player, 0, tag, datatypes.Status{Message: message}.Marshal(player.version), pbKey)
+}
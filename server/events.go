@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reseau2TP2/datatypes"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/notnil/chess"
+)
+
+// eventBuffer is how many events a slow subscriber may fall behind before
+// it starts missing some.
+const eventBuffer = 16
+
+// eventHeartbeat keeps idle streams from being closed by proxies.
+const eventHeartbeat = 15 * time.Second
+
+// moveEvent is published every time a move of a game is saved, and when a
+// game ends without a move, with Move left empty.
+type moveEvent struct {
+	GameID  string `json:"gameID"`
+	Move    string `json:"move"`
+	FEN     string `json:"fen"`
+	Outcome string `json:"outcome"`
+	Method  string `json:"method"`
+	// WhiteTime and BlackTime are the clocks of timed games in
+	// milliseconds once the move was played
+	WhiteTime int64 `json:"whiteTime,omitempty"`
+	BlackTime int64 `json:"blackTime,omitempty"`
+}
+
+// subscription receives the events of one game, or of all games when gameID
+// is empty.
+type subscription struct {
+	gameID string
+	events chan moveEvent
+}
+
+func (srv *Server) subscribe(gameID string) *subscription {
+	sub := &subscription{gameID: gameID, events: make(chan moveEvent, eventBuffer)}
+	srv.subscriptionsMutex.Lock()
+	srv.subscriptions[sub] = struct{}{}
+	srv.subscriptionsMutex.Unlock()
+	return sub
+}
+
+func (srv *Server) unsubscribe(sub *subscription) {
+	srv.subscriptionsMutex.Lock()
+	delete(srv.subscriptions, sub)
+	srv.subscriptionsMutex.Unlock()
+}
+
+// publishMove sends the last move of game to its subscribers. It is called
+// right after the move is saved and never blocks on a slow subscriber.
+func (srv *Server) publishMove(gameID string, game *chess.Game) {
+	srv.clocksMutex.Lock()
+	move := lastMove(game)
+	srv.clocksMutex.Unlock()
+	srv.publish(gameID, game, move)
+}
+
+// publishEnd tells the subscribers of game it ended without a move, by
+// resignation, agreement, claim or on time.
+func (srv *Server) publishEnd(gameID string, game *chess.Game) {
+	srv.publish(gameID, game, "")
+}
+
+func (srv *Server) publish(gameID string, game *chess.Game, move string) {
+	srv.clocksMutex.Lock()
+	event := moveEvent{
+		GameID:  gameID,
+		Move:    move,
+		FEN:     game.FEN(),
+		Outcome: game.Outcome().String(),
+		Method:  endMethod(game),
+	}
+	srv.clocksMutex.Unlock()
+	if record, err := srv.db.getGame(gameID); err == nil && record.TimeControl.Timed() {
+		event.WhiteTime = record.WhiteTime.Milliseconds()
+		event.BlackTime = record.BlackTime.Milliseconds()
+	}
+
+	srv.subscriptionsMutex.Lock()
+	defer srv.subscriptionsMutex.Unlock()
+	for sub := range srv.subscriptions {
+		if sub.gameID != "" && sub.gameID != gameID {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			log.Println("Dropping event for slow subscriber of", gameID)
+		}
+	}
+}
+
+// lastMove returns the last move of game in algebraic notation.
+func lastMove(game *chess.Game) string {
+	moves := game.Moves()
+	positions := game.Positions()
+	if len(moves) == 0 || len(positions) < 2 {
+		return ""
+	}
+	return chess.AlgebraicNotation{}.Encode(positions[len(positions)-2], moves[len(moves)-1])
+}
+
+func (srv *Server) handleAPIEvents(w http.ResponseWriter, r *http.Request) {
+	srv.streamEvents(w, r, "")
+}
+
+func (srv *Server) handleAPIGameEvents(w http.ResponseWriter, r *http.Request) {
+	gameUUID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil || !srv.db.gameExists(gameUUID.String()) {
+		writeAPIError(w, http.StatusNotFound, datatypes.CodeUnknownGame, "Unknown game")
+		return
+	}
+	srv.streamEvents(w, r, gameUUID.String())
+}
+
+// streamEvents serves the move events of gameID, or of all games, as
+// server-sent events until the client goes away.
+func (srv *Server) streamEvents(w http.ResponseWriter, r *http.Request, gameID string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, datatypes.CodeInternal, "Streaming not supported")
+		return
+	}
+	sub := srv.subscribe(gameID)
+	defer srv.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err := fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+		case event := <-sub.events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: move\ndata: %s\n\n", data)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
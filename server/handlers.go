@@ -0,0 +1,720 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/notnil/chess"
+	"github.com/notnil/chess/uci"
+	"log"
+	"reseau2TP2/datatypes"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+)
+
+type handler func(srv *Server, s *session, tlv datatypes.TLV)
+
+var handlers = map[uint8]handler{
+	0x00: (*Server).handleLogin,
+	0x01: (*Server).handleFraming,
+	0x02: (*Server).handleKeepAlive,
+	0x04: (*Server).handleKeyExchange,
+	0x05: (*Server).handleHello,
+	0x06: (*Server).handleRegister,
+	0x1D: (*Server).handleJoinSolo,
+	0x1E: (*Server).handleHostGame,
+	0x1F: (*Server).handleGetAvailableGames,
+	0x20: (*Server).handleJoinGame,
+	0x21: (*Server).handlePlayMove,
+	0x22: (*Server).handleGetAvailableMoves,
+	0x23: (*Server).handleGetProfile,
+	0x24: (*Server).handleUpdateProfile,
+	0x25: (*Server).handleJoinQueue,
+	0x26: (*Server).handleLeaveQueue,
+	0x27: (*Server).handleResign,
+	0x28: (*Server).handleOfferDraw,
+	0x29: (*Server).handleAnswerDraw,
+	0x2A: (*Server).handleClaimDraw,
+}
+
+// commands lists the tags in handlers, announced in the hello
+var commands []uint8
+
+func init() {
+	for tag := range handlers {
+		commands = append(commands, tag)
+	}
+	slices.Sort(commands)
+}
+
+// dispatch runs the handler of tlv. A handler that panics fails its request
+// only: the peer gets an internal error and the server keeps serving.
+func (srv *Server) dispatch(s *session, tlv datatypes.TLV) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Handler for tag %#x panicked: %v\n%s", tlv.Tag, r, debug.Stack())
+			sendError(s, tlv, datatypes.CodeInternal, "Internal error")
+		}
+	}()
+
+	h, ok := handlers[tlv.Tag]
+	if !ok {
+		log.Println("Unknown tag:", tlv.Tag)
+		sendError(s, tlv, datatypes.CodeUnknownCommand, "Unknown command")
+		return
+	}
+	if s.hasSessionKey() && datatypes.IsSessionTag(tlv.Tag) {
+		err := s.cipher.Open(&tlv)
+		if err != nil {
+			log.Println(err)
+			sendError(s, tlv, datatypes.CodeMalformedRequest, "Could not open sealed request")
+			return
+		}
+	}
+	if s.compression {
+		err := datatypes.Decompress(&tlv)
+		if err != nil {
+			log.Println(err)
+			sendError(s, tlv, datatypes.CodeMalformedRequest, "Could not decompress request")
+			return
+		}
+	}
+	h(srv, s, tlv)
+}
+
+// handleLogin opens a session for a registered player. From
+// RegistrationVersion on, the request only proves possession of the key: it
+// is signed and carries nothing else. Older clients send their profile, which
+// registers unknown keys with the server's initial rating.
+func (srv *Server) handleLogin(s *session, tlv datatypes.TLV) {
+	log.Println("Login")
+	if s.version < datatypes.RegistrationVersion {
+		srv.legacyLogin(s, tlv)
+		return
+	}
+
+	key, err := srv.lookupKey(tlv.KeyID())
+	if errors.Is(err, sql.ErrNoRows) {
+		sendError(s, tlv, datatypes.CodeUnknownUser, "Not registered")
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not load player")
+		return
+	}
+	if verified, _ := tlv.Verify(key.publicKey); !verified {
+		sendError(s, tlv, datatypes.CodeInvalidSignature, "Invalid signature")
+		return
+	}
+	if !srv.fresh(s, tlv, key.playerID) {
+		return
+	}
+	srv.acceptLogin(s, tlv, key.publicKey, key.playerID)
+}
+
+// legacyLogin logs in a client older than RegistrationVersion with the
+// profile it sends. Unsigned logins only register new keys: logging in as an
+// existing player takes a login signed with their key.
+func (srv *Server) legacyLogin(s *session, tlv datatypes.TLV) {
+	var user datatypes.User
+	signed := false
+	if !s.hello {
+		if user.Unmarshal(tlv.LegacyPayload(), s.version) == nil {
+			signed, _ = tlv.VerifyLegacy(user.PublicKey)
+		}
+	} else if user.Unmarshal(tlv.Payload(), s.version) == nil {
+		signed, _ = tlv.Verify(user.PublicKey)
+	}
+	if !signed {
+		user = datatypes.User{}
+		err := user.Unmarshal(tlv.Value, s.version)
+		if err != nil {
+			log.Println("Malformed login")
+			sendError(s, tlv, datatypes.CodeMalformedRequest, "Malformed login")
+			return
+		}
+	}
+	key := user.PublicKey
+	if srv.db.publicKeyExists(key) {
+		if !signed {
+			sendError(s, tlv, datatypes.CodeInvalidSignature, "Login must be signed")
+			return
+		}
+		// Legacy signatures have no timestamp or nonce to check
+		if s.hello && !srv.fresh(s, tlv, srv.db.getPlayerIDFromPublicKey(key)) {
+			return
+		}
+	} else {
+		// Names are held to the rules of handleRegister
+		user.FirstName = strings.TrimSpace(user.FirstName)
+		user.LastName = strings.TrimSpace(user.LastName)
+		if !validName(user.FirstName) || !validName(user.LastName) {
+			sendError(s, tlv, datatypes.CodeMalformedRequest, "Invalid name")
+			return
+		}
+		// The rating and the status are not the client's to declare
+		user.Elo = initialRating
+		user.IsActive = true
+		err := srv.db.createNewUser(&user)
+		if err != nil {
+			log.Println(err)
+			sendError(s, tlv, datatypes.CodeInternal, "Could not create user")
+			return
+		}
+	}
+	srv.acceptLogin(s, tlv, key, srv.db.getPlayerIDFromPublicKey(key))
+}
+
+// acceptLogin answers a login with the server keys and files the session
+// under the player.
+func (srv *Server) acceptLogin(s *session, tlv datatypes.TLV, publicKey string, playerID int) {
+	response := datatypes.NewTLV(0x03, []byte(srv.advertisedKeys()))
+	response.ID = tlv.ID
+	err := s.send(response)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	s.register(publicKey, playerID)
+}
+
+// handleFraming answers a framing negotiation. The answer is still sent with
+// the current framing, the new one applies to every following TLV.
+func (srv *Server) handleFraming(s *session, tlv datatypes.TLV) {
+	log.Println("Framing")
+	framing := datatypes.ParseFraming(string(tlv.Value))
+	response := datatypes.NewTLV(0x01, []byte(framing.String()))
+	response.ID = tlv.ID
+	err := s.send(response)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	s.framing = framing
+}
+
+// handleHello answers a client hello with the version and capabilities both
+// support, and the commands the server accepts. Like the framing negotiation,
+// the answer is sent with the current settings and the agreed ones apply to
+// every following TLV. Clients that never send a hello speak version 1.
+func (srv *Server) handleHello(s *session, tlv datatypes.TLV) {
+	log.Println("Hello")
+	peer, err := datatypes.ParseHello(tlv.Value)
+	if err != nil {
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Malformed hello")
+		return
+	}
+	server := datatypes.Hello{
+		Version:      datatypes.ProtocolVersion,
+		Capabilities: datatypes.SupportedCapabilities,
+		Commands:     commands,
+	}
+	agreed := server.Negotiate(peer)
+	response := agreed.TLV()
+	response.ID = tlv.ID
+	err = s.send(response)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	s.version = agreed.Version
+	s.peerCommands = peer.Commands
+	s.hello = true
+	s.framing = agreed.Framing()
+	s.compression = agreed.Has(datatypes.CapCompression)
+}
+
+// handleKeepAlive does nothing, receiving it is enough to keep a UDP session
+// from expiring.
+func (srv *Server) handleKeepAlive(s *session, tlv datatypes.TLV) {}
+
+// handleKeyExchange derives a session key from the client's signed ephemeral
+// X25519 key. The answer carries the server ephemeral key followed by the
+// client's, signed with the server key so the client knows who it agreed with.
+func (srv *Server) handleKeyExchange(s *session, tlv datatypes.TLV) {
+	log.Println("KeyExchange")
+	if s.hasSessionKey() {
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Session key already established")
+		return
+	}
+	playerID, ok := srv.authenticate(s, &tlv, false)
+	if !ok {
+		return
+	}
+	if len(tlv.Value) != datatypes.EphemeralKeySize {
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Invalid ephemeral key")
+		return
+	}
+	clientPublic := tlv.Value
+
+	ephemeral, err := datatypes.GenerateEphemeralKey()
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not generate ephemeral key")
+		return
+	}
+	cipher, err := datatypes.NewSessionCipher(ephemeral, clientPublic, true)
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Invalid ephemeral key")
+		return
+	}
+
+	response := datatypes.NewTLV(0x04, append(ephemeral.PublicKey().Bytes(), clientPublic...))
+	response.ID = tlv.ID
+	err = response.Sign(srv.keyPair.PrivateKey)
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not sign key exchange")
+		return
+	}
+	err = s.establish(response, cipher, playerID)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (srv *Server) handleJoinSolo(s *session, tlv datatypes.TLV) {
+	log.Println("JoinSolo")
+	srv.createGame(s, tlv, 0)
+}
+
+func (srv *Server) handleHostGame(s *session, tlv datatypes.TLV) {
+	log.Println("HostGame")
+	srv.createGame(s, tlv, -1)
+}
+
+// createGame creates a game against blackID: 0 for the AI, -1 for a hosted
+// game waiting for an opponent, which may be timed.
+func (srv *Server) createGame(s *session, tlv datatypes.TLV, blackID int) {
+	whiteID, ok := srv.authenticate(s, &tlv, false)
+	if !ok {
+		return
+	}
+	var request datatypes.HostRequest
+	if blackID == -1 {
+		err := request.Unmarshal(tlv.Value)
+		if err != nil {
+			sendError(s, tlv, datatypes.CodeMalformedRequest, "Malformed time control")
+			return
+		}
+	}
+
+	if !srv.checkActive(s, tlv, whiteID) {
+		return
+	}
+
+	gameID := uuid.New()
+	//TODO: add collision detection
+	inGame, err := srv.playerInGame(whiteID)
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not load games")
+		return
+	}
+	if inGame {
+		sendError(s, tlv, datatypes.CodeAlreadyInGame, "Player already in game")
+		return
+	}
+	err = srv.db.createNewGame(gameID.String(), whiteID, blackID, request.TimeControl)
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not create game")
+		return
+	}
+
+	srv.leaveQueue(whiteID)
+	sendSigned(s, tlv.ID, 0x82, datatypes.GameReference{GameID: gameID}.Marshal(s.version))
+}
+
+func (srv *Server) handleGetAvailableGames(s *session, tlv datatypes.TLV) {
+	log.Println("GetAvailableGames")
+	_, ok := srv.authenticate(s, &tlv, false)
+	if !ok {
+		return
+	}
+
+	games, err := srv.db.getUnstartedGames()
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not load games")
+		return
+	}
+	var gameList datatypes.GameList
+	for _, game := range games {
+		gameID, err := uuid.Parse(game)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		gameList.GameIDs = append(gameList.GameIDs, gameID)
+	}
+	sendSigned(s, tlv.ID, 0x82, gameList.Marshal(s.version))
+}
+
+func (srv *Server) handleJoinGame(s *session, tlv datatypes.TLV) {
+	log.Println("JoinGame")
+	playerID, ok := srv.authenticate(s, &tlv, false)
+	if !ok {
+		return
+	}
+	var request datatypes.GameReference
+	err := request.Unmarshal(tlv.Value, s.version)
+	if err != nil {
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Invalid game ID")
+		return
+	}
+	gameUUID := request.GameID
+	gameID := gameUUID.String()
+
+	if !srv.checkActive(s, tlv, playerID) {
+		return
+	}
+	inGame, err := srv.playerInGame(playerID)
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not load games")
+		return
+	}
+	if inGame {
+		sendError(s, tlv, datatypes.CodeAlreadyInGame, "Player already in game")
+		return
+	}
+
+	srv.gamesMutex.Lock()
+	cached := srv.games[gameUUID] != nil
+	srv.gamesMutex.Unlock()
+	if !cached && !srv.db.gameExists(gameID) {
+		sendError(s, tlv, datatypes.CodeUnknownGame, "Unknown game")
+		return
+	}
+	err = srv.db.joinGame(gameID, playerID)
+	if errors.Is(err, errGameNotJoinable) {
+		sendError(s, tlv, datatypes.CodeGameNotJoinable, "Game not joinable")
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not join game")
+		return
+	}
+
+	srv.startClock(gameID)
+	srv.leaveQueue(playerID)
+	sendSigned(s, tlv.ID, 0x82, request.Marshal(s.version))
+}
+
+func (srv *Server) handlePlayMove(s *session, tlv datatypes.TLV) {
+	log.Println("PlayMove")
+	playerID, ok := srv.authenticate(s, &tlv, true)
+	if !ok {
+		return
+	}
+
+	gameID, game, ok := srv.activeGame(s, tlv, playerID)
+	if !ok {
+		return
+	}
+	pbKey, err := srv.db.getPlayerPublicKey(playerID)
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not load player")
+		return
+	}
+
+	var request datatypes.MoveRequest
+	err = request.Unmarshal(tlv.Value, s.version)
+	if err != nil {
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Malformed move")
+		return
+	}
+	_, err = srv.submitMove(s, gameID, game, playerID, request.Move, func(record gameRecord, over bool, ratings map[int]ratingChange) {
+		if over {
+			sendEncrypted(s, tlv.ID, 0x80, moveUpdate(s, record, game, ratings[playerID]), pbKey)
+		} else {
+			sendEncrypted(s, tlv.ID, 0x82, datatypes.Status{Message: "Move successful"}.Marshal(s.version), pbKey)
+		}
+	})
+	switch {
+	case errors.Is(err, errAIFailed):
+		// The move was already answered
+		log.Println(err)
+	case err != nil:
+		code, message := moveError(err)
+		sendError(s, tlv, code, message)
+	}
+}
+
+// errAIFailed is returned by submitMove when the AI could not answer a move
+// that was played.
+var errAIFailed = errors.New("AI could not play")
+
+// submitMove plays move for playerID in gameID and lets everyone else know:
+// the event subscribers, then the AI answering in solo games or else the
+// opponent. answer, when not nil, answers the player once their move is
+// saved and before the AI thinks, with whether it ended the game and the
+// rating changes if so. s is the connection of the player the AI pushes its
+// move on, nil when they have none. The record returned has the clocks after
+// the move. Errors are those of playMove, or errAIFailed once the move was
+// played.
+func (srv *Server) submitMove(s *session, gameID string, game *chess.Game, playerID int, move string, answer func(record gameRecord, over bool, ratings map[int]ratingChange)) (gameRecord, error) {
+	record, err := srv.playMove(gameID, game, playerID, move)
+	switch {
+	case errors.Is(err, errTimeForfeit):
+		// The player lost on time, the game ends like on a final move
+		srv.publishEnd(gameID, game)
+	case err != nil:
+		return record, err
+	default:
+		srv.publishMove(gameID, game)
+	}
+
+	srv.clocksMutex.Lock()
+	over := game.Outcome() != chess.NoOutcome
+	srv.clocksMutex.Unlock()
+	var ratings map[int]ratingChange
+	if over {
+		ratings = srv.rateGame(gameID, game)
+	}
+	if answer != nil {
+		answer(record, over, ratings)
+	}
+
+	if record.BlackID == 0 && !over {
+		pbKey, _ := srv.db.getPlayerPublicKey(playerID)
+		err = srv.playAIMove(s, gameID, game, pbKey)
+		if err != nil {
+			return record, fmt.Errorf("%w: %v", errAIFailed, err)
+		}
+		return record, nil
+	}
+	srv.notifyOpponent(record, game, playerID, ratings)
+	return record, nil
+}
+
+// moveError is the error code and message of a move submitMove failed to
+// play, logging the unexpected ones.
+func moveError(err error) (datatypes.ErrorCode, string) {
+	switch {
+	case errors.Is(err, errNotYourTurn):
+		return datatypes.CodeNotYourTurn, "Not your turn"
+	case errors.Is(err, errGameOver):
+		return datatypes.CodeInvalidMove, "Game is over"
+	case errors.Is(err, errInvalidMove):
+		log.Println(err)
+		return datatypes.CodeInvalidMove, "Invalid move"
+	default:
+		log.Println(err)
+		return datatypes.CodeInternal, "Could not save game"
+	}
+}
+
+// notifyOpponent pushes the board after a move of moverID to the other
+// player of record. ratings are the rating changes of a game that just
+// ended.
+func (srv *Server) notifyOpponent(record gameRecord, game *chess.Game, moverID int, ratings map[int]ratingChange) {
+	otherID := record.WhiteID
+	if moverID == otherID {
+		otherID = record.BlackID
+	}
+	srv.notifyPlayer(record, game, otherID, ratings)
+}
+
+// notifyPlayer pushes the board of game to playerID, if connected.
+func (srv *Server) notifyPlayer(record gameRecord, game *chess.Game, playerID int, ratings map[int]ratingChange) {
+	pbKey, _ := srv.db.getPlayerPublicKey(playerID)
+	player, err := srv.getConnectionForPlayer(pbKey)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	srv.clocksMutex.Lock()
+	over := game.Outcome() != chess.NoOutcome
+	srv.clocksMutex.Unlock()
+	if over {
+		sendEncrypted(player, 0, 0x80, moveUpdate(player, record, game, ratings[playerID]), pbKey)
+		return
+	}
+	sendEncrypted(player, 0, 0x81, moveUpdate(player, record, game, ratingChange{}), pbKey)
+}
+
+// activeGame loads the game playerID is playing, answering the request with
+// an error when there is none.
+func (srv *Server) activeGame(s *session, request datatypes.TLV, playerID int) (string, *chess.Game, bool) {
+	gameID, err := srv.db.findActiveGame(playerID)
+	if err != nil {
+		log.Println(err)
+		sendError(s, request, datatypes.CodeInternal, "Could not find game")
+		return "", nil, false
+	}
+	gameUUID, err := uuid.Parse(gameID)
+	if err != nil {
+		sendError(s, request, datatypes.CodeNotInGame, "Player not in game")
+		return "", nil, false
+	}
+	game, err := srv.cachedGame(gameUUID)
+	if err != nil {
+		log.Println(err)
+		sendError(s, request, datatypes.CodeInternal, "Could not load game")
+		return "", nil, false
+	}
+	return gameID, game, true
+}
+
+// cachedGame returns the game from the cache, loading it on first use.
+func (srv *Server) cachedGame(gameUUID uuid.UUID) (*chess.Game, error) {
+	srv.gamesMutex.Lock()
+	defer srv.gamesMutex.Unlock()
+	if srv.games[gameUUID] == nil {
+		game, err := srv.loadGame(gameUUID.String())
+		if err != nil {
+			return nil, err
+		}
+		srv.games[gameUUID] = game
+	}
+	return srv.games[gameUUID], nil
+}
+
+// playAIMove answers a move in a solo game. s is nil when the player moved
+// through the HTTP API and has no connection to push the board to. An error
+// means the engine could not play and the game is unchanged.
+func (srv *Server) playAIMove(s *session, gameID string, game *chess.Game, pbKey string) error {
+	eng, err := uci.New("stockfish")
+	if err != nil {
+		return err
+	}
+	defer eng.Close()
+	if err := eng.Run(uci.CmdUCI, uci.CmdIsReady, uci.CmdUCINewGame); err != nil {
+		return err
+	}
+
+	srv.clocksMutex.Lock()
+	position := game.Position()
+	srv.clocksMutex.Unlock()
+	cmdPos := uci.CmdPosition{Position: position}
+	cmdGo := uci.CmdGo{MoveTime: 2 * time.Second}
+	if err := eng.Run(cmdPos, cmdGo); err != nil {
+		return err
+	}
+	move := eng.SearchResults().BestMove
+	if move == nil {
+		return errors.New("Engine found no move")
+	}
+	// The engine move is played like any other, in case the game ended
+	// while it was thinking
+	_, err = srv.playMove(gameID, game, 0, chess.AlgebraicNotation{}.Encode(position, move))
+	if err != nil {
+		return err
+	}
+	srv.publishMove(gameID, game)
+
+	if s == nil {
+		return nil
+	}
+	srv.clocksMutex.Lock()
+	over := game.Outcome() != chess.NoOutcome
+	fen, board := game.FEN(), game.Position().Board().Draw()
+	srv.clocksMutex.Unlock()
+	if over {
+		sendEncrypted(s, 0, 0x80, boardUpdate(s, fen), pbKey)
+		return nil
+	}
+	sendEncrypted(s, 0, 0x81, boardUpdate(s, board), pbKey)
+	return nil
+}
+
+func (srv *Server) handleGetAvailableMoves(s *session, tlv datatypes.TLV) {
+	log.Println("GetAvailableMoves")
+	playerID, ok := srv.authenticate(s, &tlv, true)
+	if !ok {
+		return
+	}
+
+	_, game, ok := srv.activeGame(s, tlv, playerID)
+	if !ok {
+		return
+	}
+
+	var moves datatypes.MoveList
+	srv.clocksMutex.Lock()
+	for _, move := range game.ValidMoves() {
+		algebraic, err := parseAlgebraicNotation(move, game.Position().Board())
+		if err != nil {
+			log.Println(err)
+			break
+		}
+
+		moves.Moves = append(moves.Moves, algebraic)
+	}
+	srv.clocksMutex.Unlock()
+
+	pbKey, err := srv.db.getPlayerPublicKey(playerID)
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not load player")
+		return
+	}
+	sendEncrypted(s, tlv.ID, 0x82, moves.Marshal(s.version), pbKey)
+}
+
+// boardUpdate encodes board for the peer of s.
+func boardUpdate(s *session, board string) []byte {
+	return datatypes.BoardUpdate{Board: board}.Marshal(s.version)
+}
+
+// moveUpdate encodes the board of game after a move for the peer of s, with
+// the clocks of record in timed games and the rating change of the peer when
+// the move ended a rated game.
+func moveUpdate(s *session, record gameRecord, game *chess.Game, rating ratingChange) []byte {
+	s.srv.clocksMutex.Lock()
+	board := game.Position().Board().Draw()
+	s.srv.clocksMutex.Unlock()
+	update := datatypes.BoardUpdate{
+		Board:        board,
+		RatingBefore: rating.Before,
+		RatingAfter:  rating.After,
+	}
+	if record.TimeControl.Timed() {
+		update.WhiteTime = record.WhiteTime
+		update.BlackTime = record.BlackTime
+	}
+	return update.Marshal(s.version)
+}
+
+// sendEncrypted sends value on s, confidential to the owner of pbKey. id is
+// the ID of the request answered, 0 for events pushed to the player.
+func sendEncrypted(s *session, id uint32, tag uint8, value []byte, pbKey string) {
+	tlv := datatypes.NewTLV(tag, value)
+	tlv.ID = id
+	err := s.sendSecured(tlv, pbKey)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// sendSigned sends value on s, authenticated by the server.
+func sendSigned(s *session, id uint32, tag uint8, value []byte) {
+	tlv := datatypes.NewTLV(tag, value)
+	tlv.ID = id
+	err := s.sendSecured(tlv, "")
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// sendError answers request with an error. Errors are signed but never RSA
+// encrypted.
+func sendError(s *session, request datatypes.TLV, code datatypes.ErrorCode, message string) {
+	tlv := datatypes.NewProtocolError(code, request.Tag, message).TLV()
+	tlv.ID = request.ID
+	err := s.sendSecured(tlv, "")
+	if err != nil {
+		log.Println(err)
+	}
+}
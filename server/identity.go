@@ -0,0 +1,188 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"log"
+	"os"
+	"reseau2TP2/datatypes"
+	"time"
+)
+
+// notAfterHeader marks a retiring key in the key file, with the end of its
+// overlap window.
+const notAfterHeader = "Not-After"
+
+// retiringKey is a former server key still advertised, and still accepted
+// for requests encrypted with it, until the end of the rotation overlap.
+type retiringKey struct {
+	keyPair  datatypes.KeyPair
+	notAfter time.Time
+}
+
+// loadIdentity loads the server key pair from the key file, creating it the
+// first time the server starts, so clients keep the key they cached across
+// restarts. Retiring keys past their overlap are dropped.
+func (srv *Server) loadIdentity(config *Config) error {
+	b, err := os.ReadFile(config.KeyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Println("Generating server key")
+		srv.keyPair, err = datatypes.GenerateKeyPair()
+		if err != nil {
+			return err
+		}
+		srv.retiringKeys = nil
+		return srv.saveIdentity(config)
+	}
+	if err != nil {
+		return err
+	}
+
+	var current *datatypes.KeyPair
+	var retiring []retiringKey
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if datatypes.IsEncryptedPEM(block) {
+			block, err = datatypes.DecryptPEM(block, config.KeyPassphrase)
+			if err != nil {
+				return err
+			}
+		}
+		key, err := keyPairOf(block)
+		if err != nil {
+			return err
+		}
+		notAfter, isRetiring := block.Headers[notAfterHeader]
+		if !isRetiring {
+			current = &key
+			continue
+		}
+		expiry, err := time.Parse(time.RFC3339, notAfter)
+		if err != nil {
+			return err
+		}
+		if time.Now().Before(expiry) {
+			retiring = append(retiring, retiringKey{keyPair: key, notAfter: expiry})
+		}
+	}
+	if current == nil {
+		return errors.New("no current key in " + config.KeyFile)
+	}
+	srv.keyPair = *current
+	srv.retiringKeys = retiring
+	return nil
+}
+
+// rotateIdentity replaces the server key with a new one. The old key keeps
+// being advertised and endorses the new one for overlap.
+func (srv *Server) rotateIdentity(config *Config, overlap time.Duration) error {
+	newKeyPair, err := datatypes.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	log.Println("Rotating server key, the old one retires in", overlap)
+	srv.retiringKeys = append(srv.retiringKeys, retiringKey{keyPair: srv.keyPair, notAfter: time.Now().Add(overlap)})
+	srv.keyPair = newKeyPair
+	return srv.saveIdentity(config)
+}
+
+// saveIdentity writes the key file, encrypting the private keys when a
+// passphrase is configured. The file is replaced atomically so a crash never
+// leaves the server without its key.
+func (srv *Server) saveIdentity(config *Config) error {
+	var out []byte
+	blocks := []*pem.Block{{Type: "RSA PRIVATE KEY", Bytes: privateKeyDER(srv.keyPair)}}
+	for _, key := range srv.retiringKeys {
+		blocks = append(blocks, &pem.Block{
+			Type:    "RSA PRIVATE KEY",
+			Headers: map[string]string{notAfterHeader: key.notAfter.UTC().Format(time.RFC3339)},
+			Bytes:   privateKeyDER(key.keyPair),
+		})
+	}
+	for _, block := range blocks {
+		if config.KeyPassphrase != "" {
+			var err error
+			block, err = datatypes.EncryptPEM(block, config.KeyPassphrase)
+			if err != nil {
+				return err
+			}
+		}
+		out = append(out, pem.EncodeToMemory(block)...)
+	}
+
+	tmp := config.KeyFile + ".tmp"
+	err := os.WriteFile(tmp, out, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, config.KeyFile)
+}
+
+// advertisedKeys is the answer to Login: the current public key endorsed by
+// every retiring key.
+func (srv *Server) advertisedKeys() string {
+	keys := datatypes.ServerKeys{Current: srv.keyPair.PublicKey}
+	for _, key := range srv.retiringKeys {
+		if time.Now().After(key.notAfter) {
+			continue
+		}
+		err := keys.Endorse(key.keyPair.PrivateKey, key.keyPair.PublicKey)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return keys.Marshal()
+}
+
+// decryptRequest RSA decrypts a request with the server key, or with a
+// retiring key for clients that have not picked up the new one yet. The key
+// that last worked on s is tried first, so a client still on a retiring key
+// does not cost a failed decryption on every request.
+func (srv *Server) decryptRequest(s *session, tlv *datatypes.TLV) error {
+	keys := []string{srv.keyPair.PrivateKey}
+	for _, key := range srv.retiringKeys {
+		if time.Now().After(key.notAfter) {
+			continue
+		}
+		if key.keyPair.PrivateKey == s.serverKey {
+			keys = append([]string{s.serverKey}, keys...)
+		} else {
+			keys = append(keys, key.keyPair.PrivateKey)
+		}
+	}
+	var err error
+	for _, key := range keys {
+		err = tlv.Decrypt(key)
+		if err == nil {
+			s.serverKey = key
+			return nil
+		}
+	}
+	return err
+}
+
+// keyPairOf rebuilds both PEM encodings from a decoded private key block.
+func keyPairOf(block *pem.Block) (datatypes.KeyPair, error) {
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return datatypes.KeyPair{}, err
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return datatypes.KeyPair{}, err
+	}
+	return datatypes.KeyPair{
+		PublicKey:  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: publicKeyBytes})),
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: block.Bytes})),
+	}, nil
+}
+
+func privateKeyDER(key datatypes.KeyPair) []byte {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	return block.Bytes
+}
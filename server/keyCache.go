@@ -0,0 +1,31 @@
+package server
+
+import (
+	"reseau2TP2/datatypes"
+)
+
+// cachedKey is a player's public key, looked up by its key ID.
+type cachedKey struct {
+	playerID  int
+	publicKey string
+}
+
+func (srv *Server) lookupKey(keyID datatypes.KeyID) (cachedKey, error) {
+	srv.keyCacheMutex.RLock()
+	key, exists := srv.keyCache[keyID]
+	srv.keyCacheMutex.RUnlock()
+	if exists {
+		return key, nil
+	}
+
+	playerID, publicKey, err := srv.db.getPlayerByKeyID(keyID.String())
+	if err != nil {
+		return cachedKey{}, err
+	}
+	key = cachedKey{playerID: playerID, publicKey: publicKey}
+
+	srv.keyCacheMutex.Lock()
+	srv.keyCache[keyID] = key
+	srv.keyCacheMutex.Unlock()
+	return key, nil
+}
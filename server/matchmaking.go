@@ -0,0 +1,242 @@
+package server
+
+import (
+	"log"
+	"math/rand/v2"
+	"reseau2TP2/datatypes"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The rating window of a queued player starts narrow and widens the longer
+// they wait, up to the range they asked for.
+const (
+	initialRatingWindow = 50
+	ratingWindowStep    = 50
+	ratingWindowEvery   = 10 * time.Second
+	defaultRatingRange  = 400
+)
+
+// matchInterval is how often the matchmaker looks for pairs.
+const matchInterval = time.Second
+
+// queueEntry is a player waiting for an opponent.
+type queueEntry struct {
+	playerID    int
+	rating      int
+	timeControl datatypes.TimeControl
+	ratingRange int
+	joined      time.Time
+	session     *session
+}
+
+// window is the largest rating difference the player accepts at now.
+func (e *queueEntry) window(now time.Time) int {
+	widened := initialRatingWindow + ratingWindowStep*int(now.Sub(e.joined)/ratingWindowEvery)
+	return min(widened, e.ratingRange)
+}
+
+func (e *queueEntry) accepts(other *queueEntry, now time.Time) bool {
+	difference := e.rating - other.rating
+	if difference < 0 {
+		difference = -difference
+	}
+	return e.playerID != other.playerID &&
+		e.timeControl == other.timeControl &&
+		difference <= e.window(now) &&
+		difference <= other.window(now)
+}
+
+// handleJoinQueue enters the player in the matchmaking queue, replacing the
+// request they were queued with if any. The pairing is pushed with MatchTag.
+func (srv *Server) handleJoinQueue(s *session, tlv datatypes.TLV) {
+	log.Println("JoinQueue")
+	playerID, ok := srv.authenticate(s, &tlv, false)
+	if !ok {
+		return
+	}
+	var request datatypes.QueueRequest
+	err := request.Unmarshal(tlv.Value)
+	if err != nil || request.RatingRange < 0 {
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Malformed queue request")
+		return
+	}
+	if request.RatingRange == 0 {
+		request.RatingRange = defaultRatingRange
+	}
+	// The pairing is pushed encrypted on this session, so it must be the
+	// one the player logged in on and the client must take the push
+	if s.playerPublicKey == "" || s.playerID != playerID {
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Log in before queueing")
+		return
+	}
+	if !s.accepts(datatypes.MatchTag) {
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Client does not accept matches")
+		return
+	}
+
+	if !srv.checkActive(s, tlv, playerID) {
+		return
+	}
+	inGame, err := srv.playerInGame(playerID)
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not load games")
+		return
+	}
+	if inGame {
+		sendError(s, tlv, datatypes.CodeAlreadyInGame, "Player already in game")
+		return
+	}
+	user, err := srv.db.getUser(playerID)
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not load player")
+		return
+	}
+
+	srv.queueMutex.Lock()
+	srv.queue[playerID] = &queueEntry{
+		playerID:    playerID,
+		rating:      user.User.Elo,
+		timeControl: request.TimeControl,
+		ratingRange: request.RatingRange,
+		joined:      time.Now(),
+		session:     s,
+	}
+	srv.queueMutex.Unlock()
+	sendSigned(s, tlv.ID, 0x82, datatypes.Status{Message: "Queued"}.Marshal(s.version))
+}
+
+func (srv *Server) handleLeaveQueue(s *session, tlv datatypes.TLV) {
+	log.Println("LeaveQueue")
+	playerID, ok := srv.authenticate(s, &tlv, false)
+	if !ok {
+		return
+	}
+	srv.leaveQueue(playerID)
+	sendSigned(s, tlv.ID, 0x82, datatypes.Status{Message: "Left queue"}.Marshal(s.version))
+}
+
+// leaveQueue takes playerID out of the queue, when the player gives up,
+// starts a game another way or goes away.
+func (srv *Server) leaveQueue(playerID int) {
+	srv.queueMutex.Lock()
+	delete(srv.queue, playerID)
+	srv.queueMutex.Unlock()
+}
+
+// dropSession takes the player of s out of the queue when they queued from s,
+// so nobody gets paired with a player who went away.
+func (srv *Server) dropSession(s *session) {
+	srv.queueMutex.Lock()
+	defer srv.queueMutex.Unlock()
+	if entry, queued := srv.queue[s.playerID]; queued && entry.session == s {
+		delete(srv.queue, s.playerID)
+	}
+}
+
+// matchmaker pairs queued players until the server shuts down.
+func (srv *Server) matchmaker() {
+	for {
+		select {
+		case <-time.After(matchInterval):
+		case <-srv.quit:
+			return
+		}
+		for _, pair := range srv.pairPlayers(time.Now()) {
+			srv.startMatch(pair[0], pair[1])
+		}
+	}
+}
+
+// pairPlayers takes compatible players out of the queue, those who waited
+// the longest first.
+func (srv *Server) pairPlayers(now time.Time) [][2]*queueEntry {
+	srv.queueMutex.Lock()
+	defer srv.queueMutex.Unlock()
+
+	entries := make([]*queueEntry, 0, len(srv.queue))
+	for _, entry := range srv.queue {
+		entries = append(entries, entry)
+	}
+	slices.SortFunc(entries, func(a, b *queueEntry) int {
+		return a.joined.Compare(b.joined)
+	})
+
+	var pairs [][2]*queueEntry
+	for i, entry := range entries {
+		if _, queued := srv.queue[entry.playerID]; !queued {
+			continue
+		}
+		for _, other := range entries[i+1:] {
+			if _, queued := srv.queue[other.playerID]; !queued || !entry.accepts(other, now) {
+				continue
+			}
+			delete(srv.queue, entry.playerID)
+			delete(srv.queue, other.playerID)
+			pairs = append(pairs, [2]*queueEntry{entry, other})
+			break
+		}
+	}
+	return pairs
+}
+
+// startMatch creates the game of a pair with random colors and pushes it to
+// both players. When the game cannot be created, both players go back to
+// the queue.
+func (srv *Server) startMatch(a *queueEntry, b *queueEntry) {
+	white, black := a, b
+	if rand.IntN(2) == 0 {
+		white, black = b, a
+	}
+	gameID := uuid.New()
+	err := srv.db.createNewGame(gameID.String(), white.playerID, black.playerID, a.timeControl)
+	if err != nil {
+		log.Println("Could not start match:", err)
+		srv.requeue(a)
+		srv.requeue(b)
+		return
+	}
+	log.Println("Paired", white.playerID, "and", black.playerID, "in", gameID)
+	if a.timeControl.Timed() {
+		srv.startClock(gameID.String())
+	}
+
+	for _, entry := range []*queueEntry{white, black} {
+		opponent := white
+		if entry == white {
+			opponent = black
+		}
+		match := datatypes.Match{
+			GameID:         gameID,
+			White:          entry == white,
+			OpponentRating: opponent.rating,
+			TimeControl:    a.timeControl,
+		}
+		if !entry.session.accepts(datatypes.MatchTag) || entry.session.playerPublicKey == "" {
+			// handleJoinQueue refuses such sessions, the push would go
+			// out unencrypted
+			continue
+		}
+		sendEncrypted(entry.session, 0, datatypes.MatchTag, match.Marshal(), entry.session.playerPublicKey)
+	}
+}
+
+// requeue puts back an entry pairPlayers took out, keeping its place, unless
+// the player queued again or left with their session meanwhile.
+func (srv *Server) requeue(entry *queueEntry) {
+	// Under queueMutex, a session going away after the check still drops
+	// the entry, see dropSession
+	srv.queueMutex.Lock()
+	defer srv.queueMutex.Unlock()
+	s, err := srv.getConnectionForPlayer(entry.session.playerPublicKey)
+	if err != nil || s != entry.session {
+		return
+	}
+	if _, queued := srv.queue[entry.playerID]; !queued {
+		srv.queue[entry.playerID] = entry
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"log"
+	"reseau2TP2/datatypes"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxNameLength is the longest first or last name, in characters.
+const maxNameLength = 64
+
+// handleRegister creates the account of the key the request is signed with.
+// Only the names come from the client: players start at the initial rating
+// and active. The answer is the new profile.
+func (srv *Server) handleRegister(s *session, tlv datatypes.TLV) {
+	log.Println("Register")
+	var user datatypes.User
+	err := user.Unmarshal(tlv.Payload(), s.version)
+	if err != nil {
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Malformed registration")
+		return
+	}
+	if verified, _ := tlv.Verify(user.PublicKey); !verified {
+		sendError(s, tlv, datatypes.CodeInvalidSignature, "Invalid signature")
+		return
+	}
+	user.FirstName = strings.TrimSpace(user.FirstName)
+	user.LastName = strings.TrimSpace(user.LastName)
+	if !validName(user.FirstName) || !validName(user.LastName) {
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Invalid name")
+		return
+	}
+	if srv.db.publicKeyExists(user.PublicKey) {
+		sendError(s, tlv, datatypes.CodeAlreadyRegistered, "Already registered")
+		return
+	}
+
+	user.Elo = initialRating
+	user.IsActive = true
+	err = srv.db.createNewUser(&user)
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not create user")
+		return
+	}
+	sendSigned(s, tlv.ID, 0x82, user.Marshal(s.version))
+}
+
+func (srv *Server) handleGetProfile(s *session, tlv datatypes.TLV) {
+	log.Println("GetProfile")
+	playerID, ok := srv.authenticate(s, &tlv, false)
+	if !ok {
+		return
+	}
+	user, err := srv.db.getUser(playerID)
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not load player")
+		return
+	}
+	sendSigned(s, tlv.ID, 0x82, user.User.Marshal(s.version))
+}
+
+// handleUpdateProfile changes the names of the player or deactivates the
+// account, answering with the updated profile. The rating only changes with
+// rated games.
+func (srv *Server) handleUpdateProfile(s *session, tlv datatypes.TLV) {
+	log.Println("UpdateProfile")
+	playerID, ok := srv.authenticate(s, &tlv, false)
+	if !ok {
+		return
+	}
+	var update datatypes.ProfileUpdate
+	err := update.Unmarshal(tlv.Value)
+	if err != nil {
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Malformed profile update")
+		return
+	}
+	update.FirstName = strings.TrimSpace(update.FirstName)
+	update.LastName = strings.TrimSpace(update.LastName)
+	if utf8.RuneCountInString(update.FirstName) > maxNameLength || utf8.RuneCountInString(update.LastName) > maxNameLength {
+		sendError(s, tlv, datatypes.CodeMalformedRequest, "Invalid name")
+		return
+	}
+
+	user, err := srv.db.updateProfile(playerID, update)
+	if err != nil {
+		log.Println(err)
+		sendError(s, tlv, datatypes.CodeInternal, "Could not update profile")
+		return
+	}
+	sendSigned(s, tlv.ID, 0x82, user.User.Marshal(s.version))
+}
+
+// checkActive tells whether playerID may start playing, answering the
+// request with an error when the account is deactivated.
+func (srv *Server) checkActive(s *session, request datatypes.TLV, playerID int) bool {
+	user, err := srv.db.getUser(playerID)
+	if err != nil {
+		log.Println(err)
+		sendError(s, request, datatypes.CodeInternal, "Could not load player")
+		return false
+	}
+	if !user.User.IsActive {
+		sendError(s, request, datatypes.CodeInactiveUser, "Account deactivated")
+		return false
+	}
+	return true
+}
+
+func validName(name string) bool {
+	return name != "" && utf8.RuneCountInString(name) <= maxNameLength
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"log"
+	"math"
+
+	"github.com/notnil/chess"
+)
+
+// initialRating is the rating of newly registered players.
+const initialRating = 1500
+
+// Elo K-factors, as FIDE uses them: new players move fast until their
+// rating settles, strong players slowly.
+const (
+	provisionalK = 40
+	standardK    = 20
+	masterK      = 10
+	// provisionalGames is how many rated games a player stays provisional
+	provisionalGames = 30
+	masterRating     = 2400
+)
+
+// ratingChange is the rating of a player before and after a game.
+type ratingChange struct {
+	Before int
+	After  int
+}
+
+// expectedScore is the score a player rated rating is expected to make
+// against opponent, between 0 and 1.
+func expectedScore(rating int, opponent int) float64 {
+	return 1 / (1 + math.Pow(10, float64(opponent-rating)/400))
+}
+
+// kFactor is how much a single game moves the rating of a player who played
+// games rated games.
+func kFactor(rating int, games int) float64 {
+	switch {
+	case games < provisionalGames:
+		return provisionalK
+	case rating < masterRating:
+		return standardK
+	default:
+		return masterK
+	}
+}
+
+// newRating is the rating after scoring score (1 win, 0.5 draw, 0 loss)
+// against opponent.
+func newRating(rating int, games int, opponent int, score float64) int {
+	return int(math.Round(float64(rating) + kFactor(rating, games)*(score-expectedScore(rating, opponent))))
+}
+
+// rateGame updates the ratings of both players of a finished game and
+// returns the changes by player ID. Games against the AI or without an
+// opponent are not rated and give no changes.
+func (srv *Server) rateGame(gameID string, game *chess.Game) map[int]ratingChange {
+	srv.clocksMutex.Lock()
+	outcome := game.Outcome()
+	srv.clocksMutex.Unlock()
+	var score float64
+	switch outcome {
+	case chess.WhiteWon:
+		score = 1
+	case chess.BlackWon:
+		score = 0
+	case chess.Draw:
+		score = 0.5
+	default:
+		return nil
+	}
+	record, err := srv.db.getGame(gameID)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	if record.BlackID <= 0 {
+		return nil
+	}
+	changes, err := srv.db.rateGame(gameID, record.WhiteID, record.BlackID, score)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return changes
+}
@@ -0,0 +1,44 @@
+package server
+
+import "testing"
+
+func TestKFactor(t *testing.T) {
+	for _, test := range []struct {
+		rating, games int
+		want          float64
+	}{
+		{initialRating, 0, provisionalK},
+		{masterRating + 100, provisionalGames - 1, provisionalK},
+		{initialRating, provisionalGames, standardK},
+		{masterRating - 1, 100, standardK},
+		{masterRating, 100, masterK},
+	} {
+		if k := kFactor(test.rating, test.games); k != test.want {
+			t.Errorf("kFactor(%d, %d) = %v, want %v", test.rating, test.games, k, test.want)
+		}
+	}
+}
+
+func TestNewRating(t *testing.T) {
+	for _, test := range []struct {
+		rating, games, opponent int
+		score                   float64
+		want                    int
+	}{
+		// Equal ratings expect half a point
+		{1500, 0, 1500, 1, 1520},
+		{1500, 0, 1500, 0.5, 1500},
+		{1500, 0, 1500, 0, 1480},
+		{1500, 50, 1500, 1, 1510},
+		{2500, 50, 2500, 0, 2495},
+		// 400 points apart expect 10 to 1
+		{1500, 50, 1900, 1, 1518},
+		{1900, 50, 1500, 0, 1882},
+		{1900, 50, 1500, 1, 1902},
+	} {
+		got := newRating(test.rating, test.games, test.opponent, test.score)
+		if got != test.want {
+			t.Errorf("newRating(%d, %d, %d, %v) = %d, want %d", test.rating, test.games, test.opponent, test.score, got, test.want)
+		}
+	}
+}
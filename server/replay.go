@@ -0,0 +1,64 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"reseau2TP2/datatypes"
+	"time"
+)
+
+// replayWindow is how far a signed request's timestamp may be from the server
+// clock. Nonces only need to be remembered for that long.
+const replayWindow = 2 * time.Minute
+
+var errStaleRequest = errors.New("Stale request")
+var errReplayedRequest = errors.New("Replayed request")
+
+// checkReplay rejects signed requests whose timestamp is outside the replay
+// window or whose nonce was already used by the same player.
+func (srv *Server) checkReplay(playerID int, tlv datatypes.TLV) error {
+	return srv.checkNonce(playerID, tlv.SignedAt(), tlv.Nonce())
+}
+
+// fresh tells whether request passes checkReplay, answering it with an
+// error when it does not.
+func (srv *Server) fresh(s *session, request datatypes.TLV, playerID int) bool {
+	err := srv.checkReplay(playerID, request)
+	if err == nil {
+		return true
+	}
+	log.Println(err)
+	code := datatypes.CodeReplayedRequest
+	if errors.Is(err, errStaleRequest) {
+		code = datatypes.CodeStaleRequest
+	}
+	sendError(s, request, code, err.Error())
+	return false
+}
+
+// checkNonce is checkReplay for requests signed outside a TLV.
+func (srv *Server) checkNonce(playerID int, signedAt time.Time, nonce [16]byte) error {
+	if signedAt.Before(time.Now().Add(-replayWindow)) || signedAt.After(time.Now().Add(replayWindow)) {
+		return errStaleRequest
+	}
+
+	srv.seenNoncesMutex.Lock()
+	defer srv.seenNoncesMutex.Unlock()
+
+	nonces, exists := srv.seenNonces[playerID]
+	if !exists {
+		nonces = make(map[[16]byte]time.Time)
+		srv.seenNonces[playerID] = nonces
+	}
+	for nonce, expiry := range nonces {
+		if time.Now().After(expiry) {
+			delete(nonces, nonce)
+		}
+	}
+
+	if _, seen := nonces[nonce]; seen {
+		return errReplayedRequest
+	}
+	nonces[nonce] = signedAt.Add(replayWindow)
+	return nil
+}
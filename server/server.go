@@ -1,102 +1,422 @@
 package server
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/notnil/chess"
-	"github.com/notnil/chess/uci"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"reseau2TP2/datatypes"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-var err error
-var games map[uuid.UUID]*chess.Game
-var keyPair datatypes.KeyPair
-var activeConnections = make(map[string]net.Conn)
-var connectionsMutex sync.Mutex
+// Server is a chess server serving every transport. Everything it serves
+// lives in the value, so several servers can run in one process as long as
+// they use their own files and addresses.
+type Server struct {
+	// Config is where the server listens, with the addresses actually
+	// bound once Start returns
+	Config Config
+
+	db           *chessDB
+	keyPair      datatypes.KeyPair
+	retiringKeys []retiringKey
+
+	// games caches the games being played, see cachedGame
+	games      map[uuid.UUID]*chess.Game
+	gamesMutex sync.Mutex
+
+	// activeConnections are the sessions of logged in players, by public key
+	activeConnections map[string]*session
+	connectionsMutex  sync.Mutex
+
+	// keyCache sits in front of the users table so identifying the signer
+	// of a request costs a map lookup instead of a query
+	keyCache      map[datatypes.KeyID]cachedKey
+	keyCacheMutex sync.RWMutex
+
+	// seenNonces are the nonces of each player still in the replay window
+	seenNonces      map[int]map[[16]byte]time.Time
+	seenNoncesMutex sync.Mutex
+
+	subscriptions      map[*subscription]struct{}
+	subscriptionsMutex sync.Mutex
+
+	// clocks are the timers flagging the player to move of timed games, and
+	// drawOffers the player who offered a draw in a game, by game ID.
+	// clocksMutex is held while a move, a flag fall or the end of a game
+	// changes a game, so they do not race, and while a cached game is read
+	clocks        map[string]*time.Timer
+	clocksStopped bool
+	drawOffers    map[string]int
+	clocksMutex   sync.Mutex
+
+	// queue holds the players waiting for matchmaking, by player ID
+	queue      map[int]*queueEntry
+	queueMutex sync.Mutex
+
+	// udpSessions are filed by address and public key, and by address only
+	udpSessions       map[udpSessionKey]*udpSession
+	udpSessionsByAddr map[string]*udpSession
+	udpSessionsMutex  sync.Mutex
+
+	tcpListener       net.Listener
+	tlsListener       net.Listener
+	websocketListener net.Listener
+	apiListener       net.Listener
+	udpConn           *net.UDPConn
+	websocketServer   *http.Server
+	apiServer         *http.Server
+
+	// quit is closed by Shutdown, ctx is the base of every HTTP request so
+	// streams end with it
+	quit   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// connections are the open TCP, TLS and WebSocket connections
+	connections map[io.Closer]struct{}
+	trackMutex  sync.Mutex
+	handlers    sync.WaitGroup
+	managers    sync.WaitGroup
+	// dbDone is closed when dbManager returned
+	dbDone chan struct{}
+	// drained is closed once Shutdown saw every request end, and closeOnce
+	// keeps it from closing the database twice
+	drained   chan struct{}
+	drainOnce sync.Once
+	closeOnce sync.Once
+}
 
-func Init() error {
-	defer log.Println("Server started")
-	db, err = initDB()
+func NewServer(config Config) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		Config:      config,
+		quit:        make(chan struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
+		connections: make(map[io.Closer]struct{}),
+		dbDone:      make(chan struct{}),
+		drained:     make(chan struct{}),
+
+		games:             make(map[uuid.UUID]*chess.Game),
+		activeConnections: make(map[string]*session),
+		keyCache:          make(map[datatypes.KeyID]cachedKey),
+		seenNonces:        make(map[int]map[[16]byte]time.Time),
+		subscriptions:     make(map[*subscription]struct{}),
+		queue:             make(map[int]*queueEntry),
+		clocks:            make(map[string]*time.Timer),
+		drawOffers:        make(map[string]int),
+		udpSessions:       make(map[udpSessionKey]*udpSession),
+		udpSessionsByAddr: make(map[string]*udpSession),
+	}
+}
+
+// Start opens the database and every listener, then serves in the
+// background. Listeners are open when Start returns, with their bound
+// addresses written back to Config so ports picked by the system can be
+// given to clients.
+func (srv *Server) Start() error {
+	config := &srv.Config
+	var err error
+	srv.db, err = initDB(config.DBPath)
 	if err != nil {
 		return err
 	}
-
 	go func() {
-		err := tcpManager()
+		defer close(srv.dbDone)
+		srv.db.manage()
+	}()
+
+	err = srv.loadIdentity(config)
+	if err != nil {
+		srv.stopDB()
+		return err
+	}
+	if config.RotateKey {
+		err = srv.rotateIdentity(config, config.KeyOverlap)
 		if err != nil {
-			log.Fatal(err)
+			srv.stopDB()
+			return err
 		}
-	}()
+	}
+
+	err = srv.resumeClocks()
+	if err != nil {
+		srv.stopDB()
+		return err
+	}
+
+	err = srv.listen()
+	if err != nil {
+		srv.stopClocks()
+		srv.closeListeners()
+		srv.stopDB()
+		return err
+	}
 
+	srv.managers.Add(5)
 	go func() {
-		err := udpManager()
-		if err != nil {
-			log.Fatal(err)
+		defer srv.managers.Done()
+		srv.serve(srv.tcpListener)
+	}()
+	go func() {
+		defer srv.managers.Done()
+		srv.serve(srv.tlsListener)
+	}()
+	go func() {
+		defer srv.managers.Done()
+		err := srv.websocketServer.Serve(srv.websocketListener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println(err)
+		}
+	}()
+	go func() {
+		defer srv.managers.Done()
+		err := srv.apiServer.Serve(srv.apiListener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println(err)
 		}
 	}()
+	go func() {
+		defer srv.managers.Done()
+		srv.udpManager()
+	}()
+
+	srv.managers.Add(3)
+	go func() {
+		defer srv.managers.Done()
+		srv.gameManager()
+	}()
+	go func() {
+		defer srv.managers.Done()
+		srv.udpSessionManager()
+	}()
+	go func() {
+		defer srv.managers.Done()
+		srv.matchmaker()
+	}()
+	log.Println("Server started")
+	return nil
+}
+
+// listen opens every listener of Config.
+func (srv *Server) listen() error {
+	config := &srv.Config
+	var err error
+	srv.tcpListener, err = net.Listen("tcp", config.TCPAddr)
+	if err != nil {
+		return err
+	}
+	config.TCPAddr = srv.tcpListener.Addr().String()
+
+	srv.tlsListener, err = listenTLS(config.TLSAddr, config.CertificateFile, config.CertificateKeyFile)
+	if err != nil {
+		return err
+	}
+	config.TLSAddr = srv.tlsListener.Addr().String()
 
-	keyPair, err = datatypes.GenerateKeyPair()
+	srv.websocketListener, err = net.Listen("tcp", config.WebSocketAddr)
+	if err != nil {
+		return err
+	}
+	config.WebSocketAddr = srv.websocketListener.Addr().String()
+	srv.websocketServer = srv.httpServer(srv.websocketHandler())
+
+	srv.apiListener, err = net.Listen("tcp", config.APIAddr)
+	if err != nil {
+		return err
+	}
+	config.APIAddr = srv.apiListener.Addr().String()
+	srv.apiServer = srv.httpServer(srv.apiRouter())
+
+	udpAddr, err := net.ResolveUDPAddr("udp", config.UDPAddr)
+	if err != nil {
+		return err
+	}
+	srv.udpConn, err = net.ListenUDP("udp", udpAddr)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	go gameManager()
-	games = make(map[uuid.UUID]*chess.Game)
+	config.UDPAddr = srv.udpConn.LocalAddr().String()
 	return nil
 }
 
-func tcpManager() error {
-	listener, err := net.Listen("tcp", "localhost:8080")
+// httpServer serves handler with the server context as base of requests.
+func (srv *Server) httpServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return srv.ctx },
+	}
+}
+
+// Shutdown stops accepting, tells connected players the server is going
+// away and closes their connections, waits for the requests in flight and
+// closes the database. If ctx ends first, Shutdown returns its error and
+// leaves the database open for the requests still running; it can then be
+// called again.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	log.Println("Server shutting down")
+	// Shutdown may be called again after ctx ended
+	select {
+	case <-srv.quit:
+	default:
+		close(srv.quit)
+	}
+	srv.cancel()
+	// The HTTP servers close their own listeners
+	srv.tcpListener.Close()
+	srv.tlsListener.Close()
+	err := srv.websocketServer.Shutdown(ctx)
 	if err != nil {
 		return err
 	}
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			return err
+	err = srv.apiServer.Shutdown(ctx)
+	if err != nil {
+		return err
+	}
+
+	// A second call waits for the same requests instead of closing the
+	// connections again
+	srv.drainOnce.Do(func() {
+		srv.notifyShutdown()
+		srv.trackMutex.Lock()
+		for c := range srv.connections {
+			c.Close()
+		}
+		srv.trackMutex.Unlock()
+		expired := srv.expireUDPSessions()
+		srv.udpConn.Close()
+
+		go func() {
+			srv.handlers.Wait()
+			for _, u := range expired {
+				<-u.stopped
+			}
+			close(srv.drained)
+		}()
+	})
+	select {
+	case <-srv.drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// Games are saved as they change, so there is nothing left to flush
+	srv.closeOnce.Do(func() {
+		srv.stopClocks()
+		srv.stopDB()
+	})
+	return nil
+}
+
+// closeListeners closes every listener opened so far, when Start fails.
+func (srv *Server) closeListeners() {
+	for _, listener := range []net.Listener{srv.tcpListener, srv.tlsListener, srv.websocketListener, srv.apiListener} {
+		if listener != nil {
+			listener.Close()
 		}
-		go handleConnection(conn)
 	}
 }
 
-func udpManager() error {
-	addr := net.UDPAddr{
-		Port: 8081,
-		IP:   net.ParseIP("127.0.0.1"),
+// stopDB stops the managers, dbManager last since the others query through
+// it, then closes the database.
+func (srv *Server) stopDB() {
+	select {
+	case <-srv.quit:
+	default:
+		close(srv.quit)
 	}
-	ser, err := net.ListenUDP("udp", &addr)
+	srv.managers.Wait()
+	close(srv.db.requests)
+	<-srv.dbDone
+	err := srv.db.db.Close()
 	if err != nil {
-		return err
+		log.Println(err)
+	}
+}
+
+// notifyShutdown tells every logged in player the server is going away.
+func (srv *Server) notifyShutdown() {
+	srv.connectionsMutex.Lock()
+	sessions := make([]*session, 0, len(srv.activeConnections))
+	for _, s := range srv.activeConnections {
+		sessions = append(sessions, s)
+	}
+	srv.connectionsMutex.Unlock()
+
+	for _, s := range sessions {
+		if !s.accepts(datatypes.ShutdownTag) {
+			continue
+		}
+		sendEncrypted(s, 0, datatypes.ShutdownTag, datatypes.Status{Message: "Server shutting down"}.Marshal(s.version), s.playerPublicKey)
 	}
+}
+
+// serve accepts connections until the listener is closed.
+func (srv *Server) serve(listener net.Listener) {
 	for {
-		p := make([]byte, 2048)
-		_, remoteaddr, err := ser.ReadFromUDP(p)
+		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Printf("Some error %v", err)
-			continue
+			select {
+			case <-srv.quit:
+			default:
+				log.Println(err)
+			}
+			return
 		}
-		go handleConnectionUDP(ser, p, remoteaddr)
+		if !srv.track(conn) {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer srv.untrack(conn)
+			srv.handleConnection(conn)
+		}()
+	}
+}
+
+// track records an open connection so Shutdown can close it, and reports
+// false when the server is already shutting down.
+func (srv *Server) track(c io.Closer) bool {
+	srv.trackMutex.Lock()
+	defer srv.trackMutex.Unlock()
+	select {
+	case <-srv.quit:
+		return false
+	default:
 	}
+	srv.connections[c] = struct{}{}
+	srv.handlers.Add(1)
+	return true
 }
 
-func gameManager() {
+func (srv *Server) untrack(c io.Closer) {
+	srv.trackMutex.Lock()
+	delete(srv.connections, c)
+	srv.trackMutex.Unlock()
+	srv.handlers.Done()
+}
+
+// gameManager evicts idle games from memory until the server shuts down.
+func (srv *Server) gameManager() {
 	for {
 		var gameUUIDs []uuid.UUID
 
-		connectionsMutex.Lock()
-		for uuid := range games {
+		srv.gamesMutex.Lock()
+		for uuid := range srv.games {
 			gameUUIDs = append(gameUUIDs, uuid)
 		}
-		connectionsMutex.Unlock()
+		srv.gamesMutex.Unlock()
 
 		for _, uuid := range gameUUIDs {
-			storedTime, err := getLastMoveTime(uuid.String())
+			storedTime, err := srv.db.getLastMoveTime(uuid.String())
 			if err != nil {
 				log.Println("Error getting last move time:", err)
 				continue
@@ -109,871 +429,147 @@ func gameManager() {
 			}
 
 			if time.Since(lastMoveTime) > 10*time.Minute {
-				connectionsMutex.Lock()
-				delete(games, uuid)
-				connectionsMutex.Unlock()
+				srv.gamesMutex.Lock()
+				delete(srv.games, uuid)
+				srv.gamesMutex.Unlock()
 			}
 		}
 
-		time.Sleep(1 * time.Minute)
+		select {
+		case <-time.After(1 * time.Minute):
+		case <-srv.quit:
+			return
+		}
 	}
 }
 
-func getConnectionForPlayer(publicKey string) (net.Conn, error) {
-	connectionsMutex.Lock()
-	defer connectionsMutex.Unlock()
+func (srv *Server) getConnectionForPlayer(publicKey string) (*session, error) {
+	srv.connectionsMutex.Lock()
+	defer srv.connectionsMutex.Unlock()
 
-	conn, exists := activeConnections[publicKey]
+	s, exists := srv.activeConnections[publicKey]
 	if !exists {
 		return nil, fmt.Errorf("no active connection for player with public key %s", publicKey)
 	}
-	return conn, nil
+	return s, nil
 }
 
-func validateSignature(tlv datatypes.TLV) bool {
-	keys, _ := getPublicKeys()
-	for _, key := range keys {
-		if _, err := tlv.Verify(key); err == nil {
-			return true
+// identifySigner verifies the signature of a request with a single key and
+// returns the ID of its owner. Sessions where a player logged in use that
+// player's key, other requests name their key by the key ID in the signature.
+func (srv *Server) identifySigner(s *session, tlv datatypes.TLV) (int, bool) {
+	keyID := tlv.KeyID()
+	key := cachedKey{playerID: s.playerID, publicKey: s.playerPublicKey}
+	if s.playerPublicKey == "" || keyID != s.keyID {
+		var err error
+		key, err = srv.lookupKey(keyID)
+		if err != nil {
+			log.Println("Unknown key", keyID, err)
+			return -1, false
 		}
 	}
-	return false
+	if verified, _ := tlv.Verify(key.publicKey); !verified {
+		return -1, false
+	}
+	return key.playerID, true
 }
 
-func getPlayerIDFromSignature(signature []byte) int {
-	keys, _ := getPublicKeys()
-	for _, key := range keys {
-		if verified := datatypes.VerifySignature(signature, key); verified {
-			return getPlayerIDFromPublicKey(key)
+// authenticate checks a request and returns the ID of the player who sent
+// it. On a session with a key, dispatch already opened the request and the
+// player is the one who did the key exchange; the session counters already
+// prevent replays. Otherwise the request carries an RSA signature and, when
+// encrypted is set, RSA encryption. Every failure is answered with an error.
+// The signature is stripped from the value on success.
+func (srv *Server) authenticate(s *session, tlv *datatypes.TLV, encrypted bool) (int, bool) {
+	if s.hasSessionKey() {
+		return s.playerID, true
+	}
+	if encrypted {
+		err := srv.decryptRequest(s, tlv)
+		if err != nil {
+			log.Println(err)
+			sendError(s, *tlv, datatypes.CodeMalformedRequest, "Could not decrypt request")
+			return -1, false
+		}
+	}
+	if !s.hello {
+		// Legacy signatures carry no key ID, timestamp or nonce: only the
+		// key logged in on the session can have made them, and replays
+		// cannot be told apart
+		verified, _ := tlv.VerifyLegacy(s.playerPublicKey)
+		if s.playerPublicKey == "" || !verified {
+			sendError(s, *tlv, datatypes.CodeInvalidSignature, "Invalid signature")
+			return -1, false
 		}
+		tlv.StripLegacySignature()
+		return s.playerID, true
+	}
+	playerID, ok := srv.identifySigner(s, *tlv)
+	if !ok {
+		sendError(s, *tlv, datatypes.CodeInvalidSignature, "Invalid signature")
+		return -1, false
+	}
+	if !srv.fresh(s, *tlv, playerID) {
+		return -1, false
 	}
-	return -1
+	tlv.StripSignature()
+	return playerID, true
 }
 
-func playerInGame(playerID int) bool {
-	gameList, err := getGamesByPlayerID(playerID)
+func (srv *Server) playerInGame(playerID int) (bool, error) {
+	gameList, err := srv.db.getGamesByPlayerID(playerID)
 	if err != nil {
-		log.Fatal(err)
+		return false, err
 	}
-	for _, game := range gameList {
-		if loadGame(game).Outcome() == chess.NoOutcome {
-			return true
+	for _, gameID := range gameList {
+		game, err := srv.loadGame(gameID)
+		if err != nil {
+			return false, err
+		}
+		if game.Outcome() == chess.NoOutcome {
+			return true, nil
 		}
 	}
-	return false
+	return false, nil
 }
 
-func loadGame(gameID string) *chess.Game {
-	pgn, err := getPGN(gameID)
+func (srv *Server) loadGame(gameID string) (*chess.Game, error) {
+	pgn, err := srv.db.getPGN(gameID)
 	if err != nil {
-		return chess.NewGame()
+		return chess.NewGame(), nil
 	}
 	game, err := chess.PGN(strings.NewReader(pgn))
 	if err != nil {
-		log.Fatal(err)
-	}
-	return chess.NewGame(game)
-}
-
-func handleConnectionUDP(c *net.UDPConn, buf []byte, addr *net.UDPAddr) {
-	log.SetPrefix("Server: ")
-	var playerPublicKey string
-
-	for {
-		tlv, err := datatypes.Decode(buf)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		_, err = c.WriteToUDP(tlv.Encode(), addr)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		switch tlv.Tag {
-		case 0x00: // Login
-			log.Println("Login")
-			val := strings.Split(string(tlv.Value[:]), ";")
-			fn := val[0]
-			ln := val[1]
-			active := val[2]
-			elo := val[3]
-			key := val[4]
-			eloInt, _ := strconv.Atoi(elo)
-			user := datatypes.User{
-				FirstName: fn,
-				LastName:  ln,
-				IsActive:  active == "1",
-				Elo:       eloInt,
-				PublicKey: key,
-			}
-			if !publicKeyExists(key) {
-				err := createNewUser(&user)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
-			tlv := datatypes.NewTLV(0x03, []byte(keyPair.PublicKey))
-			_, err = c.WriteToUDP(tlv.Encode(), addr)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			playerPublicKey = key
-
-			connectionsMutex.Lock()
-			activeConnections[playerPublicKey] = c
-			connectionsMutex.Unlock()
-		case 0x1D: // JoinSolo
-			log.Println("JoinSolo")
-			verified := validateSignature(tlv)
-			if !verified {
-				break
-			}
-
-			gameID := uuid.New()
-			whiteID := getPlayerIDFromSignature(tlv.Value[:])
-			blackID := 0
-			if playerInGame(whiteID) {
-				tlv := datatypes.NewTLV(0x82, []byte("Player already in game"))
-				tlv.Sign(keyPair.PrivateKey)
-				_, err = c.Write(tlv.Encode())
-				if err != nil {
-					log.Fatal(err)
-				}
-				break
-			}
-			createNewGame(gameID.String(), whiteID, blackID)
-
-			tlv = datatypes.NewTLV(0x82, []byte(gameID.String()))
-			tlv.Sign(keyPair.PrivateKey)
-			_, err = c.WriteToUDP(tlv.Encode(), addr)
-			if err != nil {
-				log.Fatal(err)
-			}
-		case 0x1E: // HostGame
-			log.Println("HostGame")
-			verified := validateSignature(tlv)
-			if !verified {
-				break
-			}
-
-			gameID := uuid.New()
-			whiteID := getPlayerIDFromSignature(tlv.Value[:])
-			blackID := -1
-			if playerInGame(whiteID) {
-				tlv := datatypes.NewTLV(0x82, []byte("Player already in game"))
-				tlv.Sign(keyPair.PrivateKey)
-				_, err = c.WriteToUDP(tlv.Encode(), addr)
-				if err != nil {
-					log.Fatal(err)
-				}
-				break
-			}
-			createNewGame(gameID.String(), whiteID, blackID)
-
-			tlv = datatypes.NewTLV(0x82, []byte(gameID.String()))
-			tlv.Sign(keyPair.PrivateKey)
-			_, err = c.WriteToUDP(tlv.Encode(), addr)
-			if err != nil {
-				log.Fatal(err)
-			}
-		case 0x1F: // GetAvailableGames
-			log.Println("GetAvailableGames")
-			verified := validateSignature(tlv)
-			if !verified {
-				break
-			}
-
-			gameList := getUnstartedGames()
-			var gameIDs string
-			for _, game := range gameList {
-				gameIDs += game + ";"
-			}
-			tlv = datatypes.NewTLV(0x82, []byte(gameIDs))
-			tlv.Sign(keyPair.PrivateKey)
-			_, err = c.WriteToUDP(tlv.Encode(), addr)
-			if err != nil {
-				log.Fatal(err)
-			}
-		case 0x20: // JoinGame
-			log.Println("JoinSolo")
-			verified := validateSignature(tlv)
-			if !verified {
-				break
-			}
-			val := strings.Split(string(tlv.Value[:]), ";")
-			gameID := val[0]
-			playerID := getPlayerIDFromSignature(tlv.Value[:])
-			if games[uuid.MustParse(gameID)] == nil {
-				if gameExists(gameID) {
-					joinGame(gameID, playerID)
-				}
-			} else {
-				joinGame(gameID, playerID)
-			}
-
-			tlv = datatypes.NewTLV(0x82, []byte(gameID))
-			tlv.Sign(keyPair.PrivateKey)
-			_, err = c.WriteToUDP(tlv.Encode(), addr)
-			if err != nil {
-				log.Fatal(err)
-			}
-		case 0x21: // PlayMove
-			log.Println("PlayMove")
-			err := tlv.Decrypt(keyPair.PrivateKey)
-			if err != nil {
-				log.Println(err)
-			}
-			verified := validateSignature(tlv)
-			if !verified {
-				break
-			}
-
-			playerID := getPlayerIDFromSignature(tlv.Value[:])
-			gameID, err := findActiveGame(playerID)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			if games[uuid.MustParse(gameID)] == nil {
-				games[uuid.MustParse(gameID)] = loadGame(gameID)
-			}
-
-			game := games[uuid.MustParse(gameID)]
-			pgn := game.String()
-
-			var currentID int
-			if game.Position().Turn() == chess.Black {
-				currentID, err = getBlackPlayerID(gameID)
-				if err != nil {
-					log.Println(err)
-					break
-				}
-
-			} else {
-				currentID, err = getWhitePlayerID(gameID)
-				if err != nil {
-					log.Println(err)
-					break
-				}
-			}
-
-			if currentID != playerID {
-				tlv = datatypes.NewTLV(0x83, []byte("Not your turn"))
-				tlv.Sign(keyPair.PrivateKey)
-				pbKey, err := getPlayerPublicKey(playerID)
-				if err != nil {
-					log.Println(err)
-					break
-				}
-				tlv.Encrypt(pbKey)
-				_, err = c.WriteToUDP(tlv.Encode(), addr)
-				if err != nil {
-					log.Fatal(err)
-				}
-				break
-			}
-
-			success := "Move successful"
-			val := strings.Split(string(tlv.Value[:]), ";")
-			move := val[0]
-			err = game.MoveStr(move)
-			if err != nil {
-				log.Println(err)
-				success = "Invalid move"
-				tlv = datatypes.NewTLV(0x83, []byte(success))
-				tlv.Sign(keyPair.PrivateKey)
-				pbKey, err := getPlayerPublicKey(playerID)
-				if err != nil {
-					log.Println(err)
-					break
-				}
-				tlv.Encrypt(pbKey)
-				_, err = c.WriteToUDP(tlv.Encode(), addr)
-				if err != nil {
-					log.Fatal(err)
-				}
-				break
-			}
-
-			pgn = game.String()
-			err = saveGame(gameID, pgn)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-
-			var tag uint8 = 0x82
-			if game.Outcome() != chess.NoOutcome {
-				tag = 0x80
-				success = game.FEN()
-			}
-			pbKey, err := getPlayerPublicKey(playerID)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-
-			// Send response to player
-			tlv = datatypes.NewTLV(tag, []byte(success))
-			tlv.Sign(keyPair.PrivateKey)
-			tlv.Encrypt(pbKey)
-			_, err = c.WriteToUDP(tlv.Encode(), addr)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			// TODO: handle playing against AI
-			if blackID, _ := getBlackPlayerID(gameID); blackID == 0 {
-				// AI move
-				log.Println("AI move")
-				eng, err := uci.New("stockfish")
-				if err != nil {
-					panic(err)
-				}
-				defer eng.Close()
-				if game.Outcome() == chess.NoOutcome {
-					if err := eng.Run(uci.CmdUCI, uci.CmdIsReady, uci.CmdUCINewGame); err != nil {
-						panic(err)
-					}
-
-					cmdPos := uci.CmdPosition{Position: game.Position()}
-					cmdGo := uci.CmdGo{MoveTime: 2 * time.Second}
-					if err := eng.Run(cmdPos, cmdGo); err != nil {
-						panic(err)
-					}
-					move := eng.SearchResults().BestMove
-					if err := game.Move(move); err != nil {
-						panic(err)
-					}
-
-					tag = 0x81
-					if game.Outcome() != chess.NoOutcome {
-						tag = 0x80
-						tlv = datatypes.NewTLV(tag, []byte(game.FEN()))
-						tlv.Sign(keyPair.PrivateKey)
-						tlv.Encrypt(pbKey)
-						_, err = c.WriteToUDP(tlv.Encode(), addr)
-						if err != nil {
-							log.Fatal(err)
-						}
-						break
-					}
-
-					tlv = datatypes.NewTLV(tag, []byte(game.Position().Board().Draw()))
-					tlv.Sign(keyPair.PrivateKey)
-					tlv.Encrypt(pbKey)
-					_, err = c.WriteToUDP(tlv.Encode(), addr)
-					if err != nil {
-						log.Fatal(err)
-					}
-
-					break
-				}
-			}
-
-			otherID, _ := getWhitePlayerID(gameID)
-			if currentID == otherID {
-				otherID, _ = getBlackPlayerID(gameID)
-			}
-			pbKey, _ = getPlayerPublicKey(otherID)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-
-			tag = 0x81
-			if game.Outcome() != chess.NoOutcome {
-				tag = 0x80
-				tlv = datatypes.NewTLV(tag, []byte(game.FEN()))
-				tlv.Sign(keyPair.PrivateKey)
-				tlv.Encrypt(pbKey)
-				_, err = c.WriteToUDP(tlv.Encode(), addr)
-				if err != nil {
-					log.Fatal(err)
-				}
-				break
-			}
-
-			tlv = datatypes.NewTLV(tag, []byte(game.FEN()))
-			tlv.Sign(keyPair.PrivateKey)
-			tlv.Encrypt(pbKey)
-			_, err = c.WriteToUDP(tlv.Encode(), addr)
-			if err != nil {
-				log.Fatal(err)
-			}
-		case 0x22: // GetAvailableMoves
-			log.Println("GetAvailableMoves")
-			err := tlv.Decrypt(keyPair.PrivateKey)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			verified := validateSignature(tlv)
-			if !verified {
-				break
-			}
-
-			playerID := getPlayerIDFromSignature(tlv.Value[:])
-			gameID, err := findActiveGame(playerID)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			if games[uuid.MustParse(gameID)] == nil {
-				games[uuid.MustParse(gameID)] = loadGame(gameID)
-			}
-
-			var moves []string
-			game := games[uuid.MustParse(gameID)]
-			for _, move := range game.ValidMoves() {
-				algebraic, err := parseAlgebraicNotation(move, game.Position().Board())
-				if err != nil {
-					log.Println(err)
-					break
-				}
-
-				moves = append(moves, algebraic)
-			}
-
-			movesString := strings.Join(moves, ";")
-			movesString = strconv.Itoa(len(moves)) + ";" + movesString
-			tlv = datatypes.NewTLV(0x82, []byte(movesString))
-			tlv.Sign(keyPair.PrivateKey)
-			pbKey, err := getPlayerPublicKey(playerID)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			tlv.Encrypt(pbKey)
-			_, err = c.WriteToUDP(tlv.Encode(), addr)
-			if err != nil {
-				log.Println(err)
-			}
-		}
+		return nil, err
 	}
+	return chess.NewGame(game), nil
 }
 
-func handleConnection(c net.Conn) {
+func (srv *Server) handleConnection(c net.Conn) {
 	log.SetPrefix("Server: ")
-	var playerPublicKey string
+	s := newSession(srv, func(b []byte) error {
+		_, err := c.Write(b)
+		return err
+	})
 
 	defer func(c net.Conn) {
-		err := c.Close()
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if playerPublicKey != "" {
-			connectionsMutex.Lock()
-			delete(activeConnections, playerPublicKey)
-			connectionsMutex.Unlock()
-		}
 		c.Close()
+		s.unregister()
 	}(c)
 
-	reader := bufio.NewReader(c)
+	reader := datatypes.NewFrameReader(c)
 	for {
-		// Read the raw bytes
-		rawBytes, err := reader.ReadBytes('\n')
+		// The framing may have been renegotiated by the previous request
+		reader.Framing = s.framing
+		tlv, err := reader.Read()
 		if err != nil {
-			fmt.Println(err)
+			// Shutdown closes the connection under the reader
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				fmt.Println(err)
+			}
 			break
 		}
 
-		// Remove the newline character
-		rawBytes = rawBytes[:len(rawBytes)-1]
-
-		// Decode the TLV
-		tlv, err := datatypes.Decode(rawBytes)
-		if err != nil {
-			fmt.Println(err)
-		}
-
-		switch tlv.Tag {
-		case 0x00: // Login
-			log.Println("Login")
-			val := strings.Split(string(tlv.Value[:]), ";")
-			fn := val[0]
-			ln := val[1]
-			active := val[2]
-			elo := val[3]
-			key := val[4]
-			eloInt, _ := strconv.Atoi(elo)
-			user := datatypes.User{
-				FirstName: fn,
-				LastName:  ln,
-				IsActive:  active == "1",
-				Elo:       eloInt,
-				PublicKey: key,
-			}
-			if !publicKeyExists(key) {
-				err := createNewUser(&user)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
-			tlv := datatypes.NewTLV(0x03, []byte(keyPair.PublicKey))
-			_, err = c.Write(tlv.Encode())
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			playerPublicKey = key
-
-			connectionsMutex.Lock()
-			activeConnections[playerPublicKey] = c
-			connectionsMutex.Unlock()
-		case 0x1D: // JoinSolo
-			log.Println("JoinSolo")
-			verified := validateSignature(tlv)
-			if !verified {
-				break
-			}
-
-			gameID := uuid.New()
-			whiteID := getPlayerIDFromSignature(tlv.Value[:])
-			blackID := 0
-			if playerInGame(whiteID) {
-				tlv := datatypes.NewTLV(0x82, []byte("Player already in game"))
-				tlv.Sign(keyPair.PrivateKey)
-				_, err = c.Write(tlv.Encode())
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				break
-			}
-			createNewGame(gameID.String(), whiteID, blackID)
-
-			tlv = datatypes.NewTLV(0x82, []byte(gameID.String()))
-			tlv.Sign(keyPair.PrivateKey)
-			_, err = c.Write(tlv.Encode())
-			if err != nil {
-				log.Fatal(err)
-			}
-		case 0x1E: // HostGame
-			log.Println("HostGame")
-			verified := validateSignature(tlv)
-			if !verified {
-				break
-			}
-
-			gameID := uuid.New()
-			//TODO: add collision detection
-			whiteID := getPlayerIDFromSignature(tlv.Value[:])
-			blackID := -1
-			if playerInGame(whiteID) {
-				tlv := datatypes.NewTLV(0x82, []byte("Player already in game"))
-				tlv.Sign(keyPair.PrivateKey)
-				_, err = c.Write(tlv.Encode())
-				if err != nil {
-					log.Fatal(err)
-				}
-				break
-			}
-			createNewGame(gameID.String(), whiteID, blackID)
-
-			tlv = datatypes.NewTLV(0x82, []byte(gameID.String()))
-			tlv.Sign(keyPair.PrivateKey)
-			_, err = c.Write(tlv.Encode())
-			if err != nil {
-				log.Fatal(err)
-			}
-		case 0x1F: // GetAvailableGames
-			log.Println("GetAvailableGames")
-			verified := validateSignature(tlv)
-			if !verified {
-				break
-			}
-
-			gameList := getUnstartedGames()
-			var gameIDs string
-			for _, game := range gameList {
-				gameIDs += game + ";"
-			}
-			tlv = datatypes.NewTLV(0x82, []byte(gameIDs))
-			tlv.Sign(keyPair.PrivateKey)
-			_, err = c.Write(tlv.Encode())
-			if err != nil {
-				log.Fatal(err)
-			}
-		case 0x20: // JoinGame
-			log.Println("JoinGame")
-			verified := validateSignature(tlv)
-			if !verified {
-				break
-			}
-			val := strings.Split(string(tlv.Value[:]), ";")
-			gameID := val[0]
-			playerID := getPlayerIDFromSignature(tlv.Value[:])
-
-			if playerInGame(playerID) {
-				tlv := datatypes.NewTLV(0x82, []byte("Player already in game"))
-				tlv.Sign(keyPair.PrivateKey)
-				_, err = c.Write(tlv.Encode())
-				if err != nil {
-					log.Println(err)
-				}
-				break
-			}
-
-			if games[uuid.MustParse(gameID)] == nil {
-				if gameExists(gameID) {
-					joinGame(gameID, playerID)
-				}
-			} else {
-				joinGame(gameID, playerID)
-			}
-
-			tlv = datatypes.NewTLV(0x82, []byte(gameID))
-			tlv.Sign(keyPair.PrivateKey)
-			_, err = c.Write(tlv.Encode())
-			if err != nil {
-				log.Fatal(err)
-			}
-		case 0x21: // PlayMove
-			log.Println("PlayMove")
-			err := tlv.Decrypt(keyPair.PrivateKey)
-			if err != nil {
-				log.Println(err)
-			}
-			verified := validateSignature(tlv)
-			if !verified {
-				break
-			}
-
-			playerID := getPlayerIDFromSignature(tlv.Value[:])
-			gameID, err := findActiveGame(playerID)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			if games[uuid.MustParse(gameID)] == nil {
-				games[uuid.MustParse(gameID)] = loadGame(gameID)
-			}
-
-			game := games[uuid.MustParse(gameID)]
-			pgn := game.String()
-
-			var currentID int
-			if game.Position().Turn() == chess.Black {
-				currentID, err = getBlackPlayerID(gameID)
-				if err != nil {
-					log.Println(err)
-					break
-				}
-
-			} else {
-				currentID, err = getWhitePlayerID(gameID)
-				if err != nil {
-					log.Println(err)
-					break
-				}
-			}
-
-			log.Println("Current ID:", currentID)
-			log.Println("Player ID:", playerID)
-			if currentID != playerID {
-				tlv = datatypes.NewTLV(0x83, []byte("Not your turn"))
-				tlv.Sign(keyPair.PrivateKey)
-				pbKey, err := getPlayerPublicKey(playerID)
-				if err != nil {
-					log.Println(err)
-					break
-				}
-				tlv.Encrypt(pbKey)
-				_, err = c.Write(tlv.Encode())
-				if err != nil {
-					log.Fatal(err)
-				}
-				break
-			}
-
-			success := "Move successful"
-			val := strings.Split(string(tlv.Value[:]), ";")
-			move := val[0]
-			err = game.MoveStr(move)
-			if err != nil {
-				log.Println(err)
-				success = "Invalid move"
-				tlv = datatypes.NewTLV(0x83, []byte(success))
-				tlv.Sign(keyPair.PrivateKey)
-				pbKey, err := getPlayerPublicKey(playerID)
-				if err != nil {
-					log.Println(err)
-					break
-				}
-				tlv.Encrypt(pbKey)
-				_, err = c.Write(tlv.Encode())
-				if err != nil {
-					log.Fatal(err)
-				}
-				break
-			}
-
-			pgn = game.String()
-			err = saveGame(gameID, pgn)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-
-			var tag uint8 = 0x82
-			if game.Outcome() != chess.NoOutcome {
-				tag = 0x80
-				success = game.Position().Board().Draw()
-			}
-			pbKey, err := getPlayerPublicKey(playerID)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-
-			// Send response to player
-			tlv = datatypes.NewTLV(tag, []byte(success))
-			tlv.Sign(keyPair.PrivateKey)
-			tlv.Encrypt(pbKey)
-			_, err = c.Write(tlv.Encode())
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			// TODO: handle playing against AI
-			if blackID, _ := getBlackPlayerID(gameID); blackID == 0 {
-				// AI move
-				eng, err := uci.New("stockfish")
-				if err != nil {
-					panic(err)
-				}
-				defer eng.Close()
-				if game.Outcome() == chess.NoOutcome {
-					if err := eng.Run(uci.CmdUCI, uci.CmdIsReady, uci.CmdUCINewGame); err != nil {
-						panic(err)
-					}
-
-					cmdPos := uci.CmdPosition{Position: game.Position()}
-					cmdGo := uci.CmdGo{MoveTime: 2 * time.Second}
-					if err := eng.Run(cmdPos, cmdGo); err != nil {
-						panic(err)
-					}
-					move := eng.SearchResults().BestMove
-					if err := game.Move(move); err != nil {
-						panic(err)
-					}
-
-					tag = 0x81
-					if game.Outcome() != chess.NoOutcome {
-						tag = 0x80
-						tlv = datatypes.NewTLV(tag, []byte(game.FEN()))
-						tlv.Sign(keyPair.PrivateKey)
-						tlv.Encrypt(pbKey)
-						_, err = c.Write(tlv.Encode())
-						if err != nil {
-							log.Fatal(err)
-						}
-						break
-					}
-
-					tlv = datatypes.NewTLV(tag, []byte(game.Position().Board().Draw()))
-					tlv.Sign(keyPair.PrivateKey)
-					tlv.Encrypt(pbKey)
-					_, err = c.Write(tlv.Encode())
-					if err != nil {
-						log.Fatal(err)
-					}
-
-					pgn = game.String()
-					err = saveGame(gameID, pgn)
-					if err != nil {
-						log.Println(err)
-					}
-
-					break
-				}
-			}
-
-			otherID, _ := getWhitePlayerID(gameID)
-			if currentID == otherID {
-				otherID, _ = getBlackPlayerID(gameID)
-			}
-			pbKey, _ = getPlayerPublicKey(otherID)
-			conn, err := getConnectionForPlayer(pbKey)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-
-			tag = 0x81
-			if game.Outcome() != chess.NoOutcome {
-				tag = 0x80
-				tlv = datatypes.NewTLV(tag, []byte(game.Position().Board().Draw()))
-				tlv.Sign(keyPair.PrivateKey)
-				tlv.Encrypt(pbKey)
-				_, err = conn.Write(tlv.Encode())
-				if err != nil {
-					log.Fatal(err)
-				}
-				break
-			}
-
-			tlv = datatypes.NewTLV(tag, []byte(game.Position().Board().Draw()))
-			tlv.Sign(keyPair.PrivateKey)
-			tlv.Encrypt(pbKey)
-			_, err = conn.Write(tlv.Encode())
-			if err != nil {
-				log.Fatal(err)
-			}
-		case 0x22: // GetAvailableMoves
-			log.Println("GetAvailableMoves")
-			err := tlv.Decrypt(keyPair.PrivateKey)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			verified := validateSignature(tlv)
-			if !verified {
-				break
-			}
-
-			playerID := getPlayerIDFromSignature(tlv.Value[:])
-			gameID, err := findActiveGame(playerID)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			if games[uuid.MustParse(gameID)] == nil {
-				games[uuid.MustParse(gameID)] = loadGame(gameID)
-			}
-
-			var moves []string
-			game := games[uuid.MustParse(gameID)]
-			for _, move := range game.ValidMoves() {
-				algebraic, err := parseAlgebraicNotation(move, game.Position().Board())
-				if err != nil {
-					log.Println(err)
-					break
-				}
-
-				moves = append(moves, algebraic)
-			}
-
-			movesString := strings.Join(moves, ";")
-			movesString = strconv.Itoa(len(moves)) + ";" + movesString
-			tlv = datatypes.NewTLV(0x82, []byte(movesString))
-			tlv.Sign(keyPair.PrivateKey)
-			pbKey, err := getPlayerPublicKey(playerID)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			tlv.Encrypt(pbKey)
-			_, err = c.Write(tlv.Encode())
-			if err != nil {
-				log.Println(err)
-			}
-		}
+		srv.dispatch(s, tlv)
 	}
 }
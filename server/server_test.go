@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	_ "github.com/mattn/go-sqlite3"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testConfig listens on ports picked by the system and keeps every file in
+// a temporary directory.
+func testConfig(t *testing.T) Config {
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.TCPAddr = "127.0.0.1:0"
+	config.UDPAddr = "127.0.0.1:0"
+	config.TLSAddr = "127.0.0.1:0"
+	config.WebSocketAddr = "127.0.0.1:0"
+	config.APIAddr = "127.0.0.1:0"
+	config.DBPath = filepath.Join(dir, "chess.db")
+	config.CertificateFile = filepath.Join(dir, "server.crt")
+	config.CertificateKeyFile = filepath.Join(dir, "server.key")
+	config.KeyFile = filepath.Join(dir, "server_identity.pem")
+	config.KeyPassphrase = ""
+	return config
+}
+
+func TestServerStartShutdown(t *testing.T) {
+	srv := NewServer(testConfig(t))
+	err := srv.Start()
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	for _, addr := range []string{srv.Config.TCPAddr, srv.Config.TLSAddr, srv.Config.WebSocketAddr, srv.Config.APIAddr} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Errorf("Dial %s: %v", addr, err)
+			continue
+		}
+		conn.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	// Calling it again must not panic
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+	if conn, err := net.Dial("tcp", srv.Config.TCPAddr); err == nil {
+		conn.Close()
+		t.Error("TCP listener still open after Shutdown")
+	}
+}
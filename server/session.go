@@ -0,0 +1,139 @@
+package server
+
+import (
+	"reseau2TP2/datatypes"
+	"slices"
+	"sync"
+)
+
+// session is the transport-agnostic view of a connected peer. TCP connections
+// and UDP datagrams both feed their TLVs into dispatch through a session.
+type session struct {
+	srv             *Server
+	playerPublicKey string
+	keyID           datatypes.KeyID
+	framing         datatypes.Framing
+	// version and compression are agreed in the hello, see handleHello
+	version     uint16
+	compression bool
+	// peerCommands are the tags the peer announced in its hello
+	peerCommands []uint8
+	// hello tells whether the peer sent one. Peers that did not sign the
+	// way everyone did before it, see datatypes.TLV.SignLegacy
+	hello      bool
+	write      func([]byte) error
+	writeMutex sync.Mutex
+	// onRegister lets the transport track the player logging in
+	onRegister func(publicKey string)
+	// playerID is the player who logged in on the session, cipher is set
+	// by the key exchange following Login
+	playerID int
+	cipher   *datatypes.SessionCipher
+	// serverKey is the private key that decrypted the last RSA encrypted
+	// request, see Server.decryptRequest
+	serverKey string
+}
+
+func newSession(srv *Server, write func([]byte) error) *session {
+	return &session{srv: srv, write: write, version: 1}
+}
+
+// send writes tlv, compressing and sealing it first when the session agreed
+// on it. Sealing happens under the write lock so counters go out in order.
+func (s *session) send(tlv datatypes.TLV) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if s.compression {
+		datatypes.Compress(&tlv)
+	}
+	if s.cipher != nil && datatypes.IsSessionTag(tlv.Tag) {
+		s.cipher.Seal(&tlv)
+	}
+	return s.write(tlv.EncodeFramed(s.framing))
+}
+
+// sendSecured sends tlv protected the best way the peer supports: sealed with
+// the session key, or else signed with the server key and, when encryptFor is
+// set, RSA encrypted for that public key.
+func (s *session) sendSecured(tlv datatypes.TLV, encryptFor string) error {
+	if !s.hasSessionKey() {
+		err := s.sign(&tlv)
+		if err != nil {
+			return err
+		}
+		if encryptFor != "" {
+			err = tlv.Encrypt(encryptFor)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return s.send(tlv)
+}
+
+// sign signs tlv with the server key, the way the peer expects.
+func (s *session) sign(tlv *datatypes.TLV) error {
+	if !s.hello {
+		return tlv.SignLegacy(s.srv.keyPair.PrivateKey)
+	}
+	return tlv.Sign(s.srv.keyPair.PrivateKey)
+}
+
+// establish sends the key exchange response and switches the session to the
+// new key atomically, so no TLV sent concurrently can fall in between.
+func (s *session) establish(response datatypes.TLV, cipher *datatypes.SessionCipher, playerID int) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if s.compression {
+		datatypes.Compress(&response)
+	}
+	err := s.write(response.EncodeFramed(s.framing))
+	if err != nil {
+		return err
+	}
+	s.cipher = cipher
+	s.playerID = playerID
+	return nil
+}
+
+// accepts tells whether the peer announced tag in its hello. Peers without a
+// hello only know the tags that predate it.
+func (s *session) accepts(tag uint8) bool {
+	return slices.Contains(s.peerCommands, tag)
+}
+
+func (s *session) hasSessionKey() bool {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	return s.cipher != nil
+}
+
+func (s *session) register(publicKey string, playerID int) {
+	if s.playerPublicKey != publicKey {
+		s.unregister()
+	}
+	s.playerPublicKey = publicKey
+	s.keyID, _ = datatypes.KeyIDOf(publicKey)
+	s.playerID = playerID
+
+	s.srv.connectionsMutex.Lock()
+	s.srv.activeConnections[publicKey] = s
+	s.srv.connectionsMutex.Unlock()
+
+	if s.onRegister != nil {
+		s.onRegister(publicKey)
+	}
+}
+
+func (s *session) unregister() {
+	if s.playerPublicKey == "" {
+		return
+	}
+
+	s.srv.connectionsMutex.Lock()
+	if s.srv.activeConnections[s.playerPublicKey] == s {
+		delete(s.srv.activeConnections, s.playerPublicKey)
+	}
+	s.srv.connectionsMutex.Unlock()
+	s.srv.dropSession(s)
+}
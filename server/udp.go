@@ -0,0 +1,260 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"reseau2TP2/datatypes"
+	"time"
+)
+
+// udpSessionKey identifies a UDP client. The public key is empty until the
+// client logs in.
+type udpSessionKey struct {
+	addr      string
+	publicKey string
+}
+
+// udpSession keeps the state of a UDP client across datagrams so the server
+// can push opponent moves to it. Requests are dispatched one at a time, in
+// order. Clients speaking reliable UDP get a reliable endpoint, older clients
+// get plain datagrams.
+type udpSession struct {
+	srv      *Server
+	key      udpSessionKey
+	session  *session
+	reliable *datatypes.ReliableUDP
+	inbox    chan udpRequest
+	done     chan struct{}
+	// stopped is closed once run returned
+	stopped  chan struct{}
+	lastSeen time.Time
+}
+
+// udpRequest is a plain datagram, decoded with the framing it describes, or a
+// reliable message, decoded by the session with the negotiated framing since
+// framings with the same header size cannot be told apart.
+type udpRequest struct {
+	tlv     datatypes.TLV
+	framing datatypes.Framing
+	message []byte
+}
+
+const udpSessionTimeout = 5 * time.Minute
+
+// maxUDPSessions bounds the sessions, and their goroutines, that datagrams
+// from new addresses can make the server create. Addresses are easily
+// spoofed, so once it is reached the sessions nobody logged in on make room
+// for new ones.
+const maxUDPSessions = 1024
+
+// udpInboxSize is how many requests of a session may wait for its dispatcher.
+const udpInboxSize = 64
+
+// udpManager reads datagrams until the server shuts down and closes the
+// connection.
+func (srv *Server) udpManager() {
+	ser := srv.udpConn
+	for {
+		p := make([]byte, 65535)
+		n, remoteaddr, err := ser.ReadFromUDP(p)
+		if err != nil {
+			select {
+			case <-srv.quit:
+				return
+			default:
+			}
+			fmt.Printf("Some error %v", err)
+			continue
+		}
+		if datatypes.IsReliableDatagram(p[:n]) {
+			srv.handleReliableUDP(ser, p[:n], remoteaddr)
+			continue
+		}
+		srv.handleConnectionUDP(ser, p[:n], remoteaddr)
+	}
+}
+
+// getUDPSession returns the session of addr, creating it when needed. It
+// returns nil when there is no room for another session.
+func (srv *Server) getUDPSession(c *net.UDPConn, addr *net.UDPAddr, reliable bool) *udpSession {
+	srv.udpSessionsMutex.Lock()
+	defer srv.udpSessionsMutex.Unlock()
+
+	u, exists := srv.udpSessionsByAddr[addr.String()]
+	if exists && (u.reliable != nil) == reliable {
+		u.lastSeen = time.Now()
+		return u
+	}
+	if exists {
+		// The client at this address restarted with another transport
+		u.expire()
+	}
+	if len(srv.udpSessionsByAddr) >= maxUDPSessions && !srv.evictAnonymousUDPSession() {
+		log.Println("Too many UDP sessions, dropping datagram from", addr)
+		return nil
+	}
+
+	write := func(b []byte) error {
+		_, err := c.WriteToUDP(b, addr)
+		return err
+	}
+	u = &udpSession{
+		srv:      srv,
+		key:      udpSessionKey{addr: addr.String()},
+		inbox:    make(chan udpRequest, udpInboxSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		lastSeen: time.Now(),
+	}
+	if reliable {
+		u.reliable = datatypes.NewReliableUDP(write)
+		write = u.reliable.Send
+	}
+	u.session = newSession(srv, write)
+	u.session.onRegister = u.rekey
+	srv.udpSessions[u.key] = u
+	srv.udpSessionsByAddr[u.key.addr] = u
+	go u.run()
+	return u
+}
+
+// evictAnonymousUDPSession expires the session nobody logged in on that was
+// seen the longest ago, and tells whether there was one. udpSessionsMutex
+// must be held.
+func (srv *Server) evictAnonymousUDPSession() bool {
+	var oldest *udpSession
+	for _, u := range srv.udpSessionsByAddr {
+		if u.key.publicKey == "" && (oldest == nil || u.lastSeen.Before(oldest.lastSeen)) {
+			oldest = u
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	oldest.expire()
+	return true
+}
+
+// rekey files the session under the public key that just logged in on it.
+func (u *udpSession) rekey(publicKey string) {
+	u.srv.udpSessionsMutex.Lock()
+	defer u.srv.udpSessionsMutex.Unlock()
+
+	delete(u.srv.udpSessions, u.key)
+	u.key.publicKey = publicKey
+	u.srv.udpSessions[u.key] = u
+}
+
+// expire removes the session from the tables. udpSessionsMutex must be held.
+func (u *udpSession) expire() {
+	delete(u.srv.udpSessions, u.key)
+	if u.srv.udpSessionsByAddr[u.key.addr] == u {
+		delete(u.srv.udpSessionsByAddr, u.key.addr)
+	}
+	close(u.done)
+	if u.reliable != nil {
+		u.reliable.Close()
+	}
+	u.session.unregister()
+}
+
+// enqueue hands req to the dispatcher of the session. It never blocks the
+// read loop shared by every client: req is dropped when the session is
+// behind, as a plain datagram lost on the way would be.
+func (u *udpSession) enqueue(req udpRequest) {
+	select {
+	case u.inbox <- req:
+	case <-u.done:
+	default:
+		log.Println("UDP session busy, dropping request from", u.key.addr)
+	}
+}
+
+func (u *udpSession) run() {
+	defer close(u.stopped)
+	for {
+		select {
+		case req := <-u.inbox:
+			tlv := req.tlv
+			if u.reliable == nil {
+				// Plain datagrams describe their own framing
+				u.session.framing = req.framing
+			} else {
+				var err error
+				tlv, err = datatypes.UnmarshalFramed(req.message, u.session.framing)
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+			}
+			u.srv.dispatch(u.session, tlv)
+		case <-u.done:
+			return
+		}
+	}
+}
+
+// udpSessionManager expires sessions of clients that went silent, until the
+// server shuts down.
+func (srv *Server) udpSessionManager() {
+	for {
+		select {
+		case <-time.After(udpSessionTimeout / 5):
+		case <-srv.quit:
+			return
+		}
+
+		srv.udpSessionsMutex.Lock()
+		for _, u := range srv.udpSessions {
+			if time.Since(u.lastSeen) > udpSessionTimeout {
+				log.Println("UDP session expired:", u.key.addr)
+				u.expire()
+			}
+		}
+		srv.udpSessionsMutex.Unlock()
+	}
+}
+
+// expireUDPSessions expires every session, returning them so their
+// requests in flight can be waited for.
+func (srv *Server) expireUDPSessions() []*udpSession {
+	srv.udpSessionsMutex.Lock()
+	defer srv.udpSessionsMutex.Unlock()
+	var expired []*udpSession
+	for _, u := range srv.udpSessions {
+		u.expire()
+		expired = append(expired, u)
+	}
+	return expired
+}
+
+// handleReliableUDP runs on the read loop so acknowledgements go out
+// immediately; completed messages are queued for the session's dispatcher.
+func (srv *Server) handleReliableUDP(c *net.UDPConn, buf []byte, addr *net.UDPAddr) {
+	u := srv.getUDPSession(c, addr, true)
+	if u == nil {
+		return
+	}
+	messages, err := u.reliable.Receive(buf)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, msg := range messages {
+		u.enqueue(udpRequest{message: msg})
+	}
+}
+
+func (srv *Server) handleConnectionUDP(c *net.UDPConn, buf []byte, addr *net.UDPAddr) {
+	tlv, framing, err := datatypes.DecodeDatagram(buf)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	u := srv.getUDPSession(c, addr, false)
+	if u == nil {
+		return
+	}
+	u.enqueue(udpRequest{tlv: tlv, framing: framing})
+}
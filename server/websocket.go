@@ -0,0 +1,71 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"reseau2TP2/datatypes"
+
+	"github.com/gorilla/websocket"
+)
+
+// websocketReadLimit bounds a single message, which holds a single TLV.
+const websocketReadLimit = 1 << 20
+
+var upgrader = websocket.Upgrader{
+	// Requests are authenticated by their signatures, not by cookies the
+	// browser would attach, so any page may open a connection.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// websocketHandler lets browsers speak the TLV protocol. Every binary
+// WebSocket message carries one TLV, framed as negotiated in the hello, and
+// goes through the same dispatcher as TCP and UDP.
+func (srv *Server) websocketHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", srv.handleWebSocket)
+	return mux
+}
+
+func (srv *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// The HTTP server forgets hijacked connections, Shutdown closes them
+	if !srv.track(conn) {
+		conn.Close()
+		return
+	}
+	defer srv.untrack(conn)
+	conn.SetReadLimit(websocketReadLimit)
+
+	// session serializes writes, as the connection requires
+	s := newSession(srv, func(b []byte) error {
+		return conn.WriteMessage(websocket.BinaryMessage, b)
+	})
+	defer func() {
+		conn.Close()
+		s.unregister()
+	}()
+
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println(err)
+			}
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			log.Println("Ignoring non binary WebSocket message")
+			continue
+		}
+		tlv, err := datatypes.UnmarshalFramed(message, s.framing)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		srv.dispatch(s, tlv)
+	}
+}